@@ -19,92 +19,274 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package client
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/brimstone/logger"
 	"github.com/brimstone/traefik-cert/types"
 )
 
+// Options describes a certificate request to the companion server. Empty
+// fields fall back to the matching environment variable.
+type Options struct {
+	URL    string
+	Domain string
+	JWT    string
+	// Resolver limits the search to a single Traefik certificate resolver.
+	// When empty the server searches every resolver.
+	Resolver string
+	// ClientCert and ClientKey are files holding a certificate to present
+	// to a server using mutual TLS. JWT isn't required when they're set.
+	ClientCert string
+	ClientKey  string
+	// Format is one of the types.Format constants, JSON when empty.
+	Format string
+	// Password protects a types.FormatPKCS12 response.
+	Password string
+	// Fingerprint of the certificate and key already held, as computed by
+	// types.Fingerprint. When the server still holds the same pair the
+	// request fails with ErrNotModified instead of sending it again.
+	Fingerprint string
+	// Timeout limits each request, including reading the response. Zero
+	// means no limit, except for Watch.
+	Timeout time.Duration
+}
+
+// ErrNotModified is returned when the server's certificate matches
+// Options.Fingerprint.
+var ErrNotModified = errors.New("certificate unchanged")
+
 func GetCert(url string, domain string, jwt string) (cert []byte, key []byte, err error) {
-	log := logger.New()
+	return GetCertWithOptions(Options{
+		URL:    url,
+		Domain: domain,
+		JWT:    jwt,
+	})
+}
 
-	// Check environment
-	if url == "" {
-		url = os.Getenv("URL")
-		if url == "" {
-			err = errors.New("URL must not be empty")
-			return
-		}
+func GetCertWithOptions(o Options) (cert []byte, key []byte, err error) {
+	o.Format = types.FormatJSON
+	var body []byte
+	body, err = Fetch(o)
+	if err != nil {
+		return
 	}
-	if domain == "" {
-		domain = os.Getenv("DOMAIN")
-		if domain == "" {
-			err = errors.New("DOMAIN must not be empty")
-			return
-		}
+
+	var response types.CertResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return
 	}
-	if jwt == "" {
-		jwt = os.Getenv("JWT")
-		if jwt == "" {
-			err = errors.New("JWT must not be empty")
-			return
-		}
+	cert = response.Cert
+	key = response.Key
+	return
+}
+
+// Fetch requests a certificate in o.Format and returns the response body
+// as the server sent it.
+func Fetch(o Options) (body []byte, err error) {
+	return fetch(context.Background(), o, "/cert/", url.Values{})
+}
+
+// fetch makes a request for the domain under path and returns the body of a
+// successful response.
+func fetch(ctx context.Context, o Options, path string, query url.Values) (body []byte, err error) {
+	err = o.defaults()
+	if err != nil {
+		return
+	}
+	return get(ctx, o, path+o.Domain, query)
+}
+
+// get makes a request for path and returns the body of a successful
+// response.
+func get(ctx context.Context, o Options, path string, query url.Values) (body []byte, err error) {
+	log := logger.New()
+
+	err = o.serverDefaults()
+	if err != nil {
+		return
 	}
 	// Build baseurl
-	baseurl := url
+	baseurl := o.URL
 	if os.Getenv("DEV") == "" {
-		if strings.HasPrefix(url, "http://") {
+		if strings.HasPrefix(o.URL, "http://") {
 			err = errors.New("URL must not be http")
 			return
 		}
-		if !strings.HasPrefix(url, "https://") {
+		if !strings.HasPrefix(o.URL, "https://") {
 			baseurl = "https://" + baseurl
 		}
 	} else {
-		if !strings.HasPrefix(url, "http://") {
+		if !strings.HasPrefix(o.URL, "http://") {
 			baseurl = "http://" + baseurl
 		}
 	}
 	log.Debug("baseurl",
 		log.Field("baseurl", baseurl),
 	)
+	if o.Resolver != "" {
+		query.Set("resolver", o.Resolver)
+	}
+	if o.Format != "" {
+		query.Set("format", o.Format)
+	}
+	requrl := baseurl + path
+	if len(query) > 0 {
+		requrl += "?" + query.Encode()
+	}
 	// Actually make request
 	var req *http.Request
-	req, err = http.NewRequest("GET", baseurl+"/cert/"+domain, nil)
+	req, err = http.NewRequestWithContext(ctx, "GET", requrl, nil)
+	if err != nil {
+		return
+	}
+	if o.JWT != "" {
+		req.Header.Set("Authorization", "Bearer "+o.JWT)
+	}
+	if o.Password != "" {
+		req.Header.Set(types.PKCS12PasswordHeader, o.Password)
+	}
+	if o.Fingerprint != "" {
+		etag := o.Fingerprint
+		if o.Format != "" && o.Format != types.FormatJSON {
+			etag += "-" + o.Format
+		}
+		req.Header.Set("If-None-Match", `"`+etag+`"`)
+	}
+
+	var httpClient *http.Client
+	httpClient, err = newHTTPClient(o)
 	if err != nil {
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+jwt)
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = httpClient.Do(req)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
-	var body []byte
 	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return
 	}
 
+	if resp.StatusCode == http.StatusNotModified {
+		err = ErrNotModified
+		body = nil
+		return
+	}
+
 	if resp.StatusCode != 200 {
 		err = errors.New(string(body))
+		body = nil
 		return
 	}
+	return
+}
 
-	var response types.CertResponse
+// defaults fills empty options from the environment and checks that enough
+// are set to make a request.
+func (o *Options) defaults() error {
+	if o.Domain == "" {
+		o.Domain = os.Getenv("DOMAIN")
+		if o.Domain == "" {
+			return errors.New("DOMAIN must not be empty")
+		}
+	}
+	return o.serverDefaults()
+}
+
+// serverDefaults fills and checks the options needed for any request to
+// the server.
+func (o *Options) serverDefaults() error {
+	if o.URL == "" {
+		o.URL = os.Getenv("URL")
+		if o.URL == "" {
+			return errors.New("URL must not be empty")
+		}
+	}
+	if o.JWT == "" {
+		o.JWT = os.Getenv("JWT")
+		if o.JWT == "" && o.ClientCert == "" {
+			return errors.New("JWT must not be empty")
+		}
+	}
+	return nil
+}
+
+// newHTTPClient returns the default client, or one presenting the client
+// certificate or limited to the timeout from the options.
+func newHTTPClient(o Options) (*http.Client, error) {
+	if o.ClientCert == "" && o.Timeout == 0 {
+		return http.DefaultClient, nil
+	}
+	httpClient := &http.Client{Timeout: o.Timeout}
+	if o.ClientCert == "" {
+		return httpClient, nil
+	}
+	cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	httpClient.Transport = transport
+	return httpClient, nil
+}
+
+// ListFilter narrows the certificates returned by List.
+type ListFilter struct {
+	// Domain keeps certificates for this domain or its subdomains.
+	Domain string
+	// ExpiresWithin keeps certificates expiring within this long.
+	ExpiresWithin time.Duration
+}
+
+// List describes every certificate the server holds that matches filter,
+// soonest to expire first. o.Resolver limits it to one resolver, and the
+// token in o needs the admin claim.
+func List(o Options, filter ListFilter) ([]types.CertInfo, error) {
+	query := url.Values{}
+	if filter.Domain != "" {
+		query.Set("domain", filter.Domain)
+	}
+	if filter.ExpiresWithin > 0 {
+		query.Set("expires_within", filter.ExpiresWithin.String())
+	}
+	body, err := get(context.Background(), o, "/admin/certs", query)
+	if err != nil {
+		return nil, err
+	}
+	var response types.CertListResponse
 	err = json.Unmarshal(body, &response)
 	if err != nil {
-		return
+		return nil, err
 	}
-	cert = response.Cert
-	key = response.Key
-	return
+	return response.Certificates, nil
+}
+
+// VerifyWebhook reports whether signature, the value of the
+// types.WebhookSignatureHeader header, matches a webhook body signed with
+// the shared secret.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
 }
@@ -0,0 +1,103 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+const (
+	// maxBackoff caps the delay between failed watch requests.
+	maxBackoff = 5 * time.Minute
+	// watchTimeout gives up on a watch request a little after the server's
+	// longest wait, so a silently dropped connection is noticed.
+	watchTimeout = 5*time.Minute + 30*time.Second
+)
+
+// Watch long-polls the server and sends every new certificate for the
+// domain on the returned channel. o.Fingerprint is the certificate already
+// held; when it's empty the current certificate is sent first. Failed
+// requests are logged and retried with backoff until ctx is done, at which
+// point the channel is closed. Each request times out after o.Timeout, or a
+// little over five minutes when it's zero.
+func Watch(ctx context.Context, o Options) (<-chan types.CertResponse, error) {
+	err := o.defaults()
+	if err != nil {
+		return nil, err
+	}
+	since := o.Fingerprint
+	o.Fingerprint = ""
+	o.Format = types.FormatJSON
+	if o.Timeout == 0 {
+		o.Timeout = watchTimeout
+	}
+
+	updates := make(chan types.CertResponse)
+	go func() {
+		defer close(updates)
+		log := logger.New()
+		backoff := time.Second
+		for ctx.Err() == nil {
+			var response types.CertResponse
+			body, err := fetch(ctx, o, "/watch/", url.Values{"since": {since}})
+			if err == nil {
+				err = json.Unmarshal(body, &response)
+			}
+			if err == ErrNotModified {
+				backoff = time.Second
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Warn("watch failed",
+					log.Field("domain", o.Domain),
+					log.Field("error", err.Error()),
+					log.Field("retry", backoff.String()),
+				)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+
+			backoff = time.Second
+			since = types.Fingerprint(response.Cert, response.Key)
+			select {
+			case updates <- response:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
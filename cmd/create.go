@@ -0,0 +1,192 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brimstone/traefik-cert/server"
+	"github.com/brimstone/traefik-cert/types"
+	"github.com/spf13/cobra"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// createCmd represents the token create command
+var createCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a token allowing a client to fetch certs",
+	Long: `Create a JWT with the cert.domains claim serve checks, signed by a private
+key. The token gets iat, nbf and exp claims and a random jti, which can be
+used to revoke it later.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyfile, _ := cmd.Flags().GetString("private-key")
+		domains, _ := cmd.Flags().GetStringSlice("domain")
+		info, _ := cmd.Flags().GetStringSlice("info")
+		subject, _ := cmd.Flags().GetString("subject")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		kid, _ := cmd.Flags().GetString("kid")
+		issuer, _ := cmd.Flags().GetString("issuer")
+		audience, _ := cmd.Flags().GetStringSlice("audience")
+		admin, _ := cmd.Flags().GetBool("admin")
+		if len(domains) == 0 && len(info) == 0 && !admin {
+			return errors.New("at least one --domain, --info or --admin is required")
+		}
+		if ttl <= 0 {
+			return errors.New("--ttl must be positive")
+		}
+
+		key, err := loadPrivateKey(keyfile)
+		if err != nil {
+			return err
+		}
+		jti := make([]byte, 16)
+		_, err = rand.Read(jti)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		claims := types.Auth{
+			Subject:   subject,
+			Issuer:    issuer,
+			Audience:  audience,
+			ID:        hex.EncodeToString(jti),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			Expires:   now.Add(ttl).Unix(),
+			Admin:     admin,
+		}
+		claims.Cert.Domains = domains
+		claims.Cert.Info = info
+
+		token, err := signToken(key, kid, claims)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	},
+}
+
+// loadPrivateKey reads a PEM private key from path, or decodes a base64
+// HMAC secret given after server.HMACSecretPrefix.
+func loadPrivateKey(path string) (interface{}, error) {
+	if encoded, ok := strings.CutPrefix(path, server.HMACSecretPrefix); ok {
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("unable to decode HMAC secret")
+		}
+		return secret, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %s", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// signingAlgorithm picks the JWS algorithm for a private key.
+func signingAlgorithm(key interface{}) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	case []byte:
+		return jose.HS256, nil
+	}
+	return "", fmt.Errorf("unsupported private key %T", key)
+}
+
+func signToken(key interface{}, kid string, claims types.Auth) (string, error) {
+	algorithm, err := signingAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+	options := &jose.SignerOptions{ExtraHeaders: map[jose.HeaderKey]interface{}{
+		"typ": "JWT",
+	}}
+	if kid != "" {
+		options.ExtraHeaders["kid"] = kid
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, options)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.CompactSerialize()
+}
+
+func init() {
+	tokenCmd.AddCommand(createCmd)
+
+	createCmd.Flags().StringP("private-key", "k", "private.key", "Private key to sign the token with, or base64:SECRET for HMAC")
+	createCmd.Flags().StringSliceP("domain", "d", nil, "Domain the token may fetch the cert and key of, may be repeated")
+	createCmd.Flags().StringSlice("info", nil, "Domain the token may only read cert metadata of, may be repeated")
+	createCmd.Flags().StringP("subject", "s", "", "Subject of the token, naming the client")
+	createCmd.Flags().Duration("ttl", 365*24*time.Hour, "How long the token is valid for")
+	createCmd.Flags().String("issuer", "", "Issuer of the token, for serve --issuer")
+	createCmd.Flags().StringSlice("audience", nil, "Audience of the token, for serve --audience, may be repeated")
+	createCmd.Flags().Bool("admin", false, "Allow the token to list every certificate through the admin API")
+	createCmd.Flags().String("kid", "", "Key ID to put in the token header, for serve to pick the key by")
+}
@@ -20,6 +20,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -36,6 +37,7 @@ import (
 	"time"
 
 	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/client"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -108,30 +110,40 @@ to quickly create a Cobra application.`,
 
 		restartChild := false
 
+		options, err := getcertOptions()
+		if err != nil {
+			return err
+		}
+		options.Fingerprint = localFingerprint(viper.GetString("cert"), viper.GetString("key"))
+		// The server answers a watch as soon as Traefik renews the cert
+		updates, err := client.Watch(context.Background(), options)
+		if err != nil {
+			return err
+		}
+
 		go func() {
 			for {
-				killChild := true
 				certSig := cert.Signature
+				// Check again by expiry, or daily, in case watching fails
 				delay := cert.NotAfter.Sub(time.Now())
-				log.Println("Cert expires in", delay)
 				if delay > time.Hour*24 {
 					delay = time.Hour * 24
-					killChild = false
 				}
-				log.Println("Recheck in", delay)
-				time.Sleep(delay)
-				log.Println("Cert expired, renewing")
+				select {
+				case <-updates:
+					log.Println("Cert changed on server, renewing")
+				case <-time.After(delay):
+					log.Println("Rechecking cert")
+				}
 				cert, err = getValidCert(0, cmd)
 				if err != nil {
 					return
 				}
 				if bytes.Equal(certSig, cert.Signature) {
-					killChild = false
-				}
-				if killChild {
-					restartChild = true
-					child.Process.Signal(syscall.SIGTERM)
+					continue
 				}
+				restartChild = true
+				child.Process.Signal(syscall.SIGTERM)
 			}
 		}()
 		time.Sleep(time.Second)
@@ -139,7 +151,7 @@ to quickly create a Cobra application.`,
 			restartChild = false
 			child = exec.Command(args[0], args[1:]...)
 			for _, e := range os.Environ() {
-				if strings.HasPrefix(e, "JWT=") {
+				if strings.HasPrefix(e, "JWT=") || strings.HasPrefix(e, "PKCS12_PASSWORD=") {
 					continue
 				}
 				child.Env = append(child.Env, e)
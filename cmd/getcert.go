@@ -27,6 +27,7 @@ import (
 	"strings"
 
 	"github.com/brimstone/traefik-cert/client"
+	"github.com/brimstone/traefik-cert/types"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -65,6 +66,26 @@ func initgetcertFlags() {
 	viper.BindPFlag("jwt", getcertFlags.Lookup("jwt"))
 	viper.BindEnv("jwt")
 
+	getcertFlags.String("client-cert", "", "Client cert to present to a server using mtls [$CLIENT_CERT]")
+	viper.BindPFlag("client-cert", getcertFlags.Lookup("client-cert"))
+	viper.BindEnv("client-cert", "CLIENT_CERT")
+
+	getcertFlags.String("client-key", "", "Key for --client-cert [$CLIENT_KEY]")
+	viper.BindPFlag("client-key", getcertFlags.Lookup("client-key"))
+	viper.BindEnv("client-key", "CLIENT_KEY")
+
+	getcertFlags.StringP("resolver", "r", "", "Traefik certificate resolver holding the cert, default any [$RESOLVER]")
+	viper.BindPFlag("resolver", getcertFlags.Lookup("resolver"))
+	viper.BindEnv("resolver")
+
+	getcertFlags.StringP("format", "F", types.FormatJSON, "Format to fetch: json, pem, der or pkcs12 [$FORMAT]")
+	viper.BindPFlag("format", getcertFlags.Lookup("format"))
+	viper.BindEnv("format")
+
+	getcertFlags.String("password", "", "Password protecting the pkcs12 format [$PKCS12_PASSWORD]")
+	viper.BindPFlag("password", getcertFlags.Lookup("password"))
+	viper.BindEnv("password", "PKCS12_PASSWORD")
+
 	getcertFlags.StringP("cert", "c", "", "Path to save cert file [$CERT]")
 	viper.BindPFlag("cert", getcertFlags.Lookup("cert"))
 	viper.BindEnv("cert")
@@ -84,27 +105,61 @@ func init() {
 	getcertCmd.Flags().AddFlagSet(getcertFlags)
 }
 
-func getcertFunc(cmd *cobra.Command, args []string) error {
+// getcertOptions builds the client options shared by getcert and exec from
+// their flags.
+func getcertOptions() (client.Options, error) {
 	domain := viper.GetString("domain")
 	if domain == "" {
-		return errors.New("must specify domain of cert to retrieve")
+		return client.Options{}, errors.New("must specify domain of cert to retrieve")
 	}
 
 	jwt := viper.GetString("jwt")
-	if jwt == "" {
-		return errors.New("JWT must be specified")
+	clientCert := viper.GetString("client-cert")
+	if jwt == "" && clientCert == "" {
+		return client.Options{}, errors.New("JWT or client cert must be specified")
 	}
 
 	url := viper.GetString("url")
 	if url == "" {
-		return errors.New("must specify URL holding certs")
+		return client.Options{}, errors.New("must specify URL holding certs")
+	}
+
+	return client.Options{
+		URL:        url,
+		Domain:     domain,
+		JWT:        jwt,
+		Resolver:   viper.GetString("resolver"),
+		ClientCert: clientCert,
+		ClientKey:  viper.GetString("client-key"),
+	}, nil
+}
+
+func getcertFunc(cmd *cobra.Command, args []string) error {
+	options, err := getcertOptions()
+	if err != nil {
+		return err
 	}
 
 	certfile := viper.GetString("cert")
 	keyfile := viper.GetString("key")
 
-	cert, key, err := client.GetCert(url, domain, jwt)
+	var cert, key []byte
+	format := viper.GetString("format")
+	if format == "" || format == types.FormatJSON {
+		options.Fingerprint = localFingerprint(certfile, keyfile)
+		cert, key, err = client.GetCertWithOptions(options)
+	} else {
+		// Every other format arrives as a single file, saved to the cert path
+		options.Format = format
+		options.Password = viper.GetString("password")
+		cert, err = client.Fetch(options)
+		keyfile = ""
+	}
 
+	if err == client.ErrNotModified {
+		fmt.Fprintln(os.Stderr, "Cert unchanged, not rewriting", certfile, keyfile)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -113,22 +168,32 @@ func getcertFunc(cmd *cobra.Command, args []string) error {
 		return errors.New("No cert in response from server")
 	}
 
+	var files []string
 	if certfile == "" {
-		fmt.Println(string(cert))
+		if format == types.FormatDER || format == types.FormatPKCS12 {
+			os.Stdout.Write(cert)
+		} else {
+			fmt.Println(string(cert))
+		}
 	} else {
 		err = ioutil.WriteFile(certfile, cert, 0600)
 		if err != nil {
 			return err
 		}
+		files = append(files, certfile)
 	}
 
-	if keyfile == "" {
+	switch {
+	case key == nil:
+		// Only the JSON format returns a separate key
+	case keyfile == "":
 		fmt.Println(string(key))
-	} else {
+	default:
 		err = ioutil.WriteFile(keyfile, key, 0600)
 		if err != nil {
 			return err
 		}
+		files = append(files, keyfile)
 	}
 
 	ownerFlag := viper.GetString("owner")
@@ -155,13 +220,11 @@ func getcertFunc(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	err = os.Chown(certfile, int(ownerID), -1)
-	if err != nil {
-		return err
-	}
-	err = os.Chown(keyfile, int(ownerID), -1)
-	if err != nil {
-		return err
+	for _, file := range files {
+		err = os.Chown(file, int(ownerID), -1)
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(ownergroup) == 1 {
@@ -187,14 +250,29 @@ func getcertFunc(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	err = os.Chown(certfile, -1, int(ownerGID))
+	for _, file := range files {
+		err = os.Chown(file, -1, int(ownerGID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localFingerprint returns the fingerprint of previously saved cert and key
+// files, or an empty string if there aren't any.
+func localFingerprint(certfile string, keyfile string) string {
+	if certfile == "" || keyfile == "" {
+		return ""
+	}
+	cert, err := ioutil.ReadFile(certfile)
 	if err != nil {
-		return err
+		return ""
 	}
-	err = os.Chown(keyfile, -1, int(ownerGID))
+	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		return err
+		return ""
 	}
-
-	return nil
+	return types.Fingerprint(cert, key)
 }
@@ -0,0 +1,133 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brimstone/traefik-cert/server"
+	"github.com/brimstone/traefik-cert/types"
+	"github.com/spf13/cobra"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// inspectCmd represents the token inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [token]",
+	Short: "Show what a token allows and check its signature",
+	Long: `Decode a token, read from the argument or stdin, and show its subject,
+validity and domains. With --public the token is also verified the way serve
+would, and an invalid token makes the command fail.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var token string
+		if len(args) == 1 && args[0] != "-" {
+			token = args[0]
+		} else {
+			raw, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			token = string(raw)
+		}
+		token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(token), "Bearer "))
+
+		obj, err := jose.ParseSigned(token)
+		if err != nil {
+			return fmt.Errorf("unable to parse token: %s", err)
+		}
+		if len(obj.Signatures) != 1 {
+			return errors.New("expected a single signature")
+		}
+		var claims types.Auth
+		err = json.Unmarshal(obj.UnsafePayloadWithoutVerification(), &claims)
+		if err != nil {
+			return fmt.Errorf("unable to decode claims: %s", err)
+		}
+
+		header := obj.Signatures[0].Header
+		fmt.Printf("Algorithm:  %s\n", header.Algorithm)
+		if header.KeyID != "" {
+			fmt.Printf("Key ID:     %s\n", header.KeyID)
+		}
+		fmt.Printf("Subject:    %s\n", claims.Subject)
+		if claims.Issuer != "" {
+			fmt.Printf("Issuer:     %s\n", claims.Issuer)
+		}
+		if len(claims.Audience) > 0 {
+			fmt.Printf("Audience:   %s\n", strings.Join(claims.Audience, ", "))
+		}
+		fmt.Printf("Token ID:   %s\n", claims.ID)
+		fmt.Printf("Issued:     %s\n", formatClaimTime(claims.IssuedAt))
+		fmt.Printf("Not before: %s\n", formatClaimTime(claims.NotBefore))
+		fmt.Printf("Expires:    %s\n", formatClaimTime(claims.Expires))
+		fmt.Printf("Domains:    %s\n", strings.Join(claims.Cert.Domains, ", "))
+		if len(claims.Cert.Info) > 0 {
+			fmt.Printf("Info only:  %s\n", strings.Join(claims.Cert.Info, ", "))
+		}
+		if claims.Admin {
+			fmt.Println("Admin:      yes")
+		}
+
+		keys, _ := cmd.Flags().GetStringSlice("public")
+		if len(keys) == 0 {
+			fmt.Println("Signature:  not checked, pass --public to verify")
+			return nil
+		}
+		issuers, _ := cmd.Flags().GetStringSlice("issuer")
+		audiences, _ := cmd.Flags().GetStringSlice("audience")
+		_, err = server.VerifyToken(keys, server.TokenRules{
+			Issuers:   issuers,
+			Audiences: audiences,
+		}, token)
+		if err != nil {
+			fmt.Println("Signature:  invalid")
+			return fmt.Errorf("token is not valid: %s", err)
+		}
+		fmt.Println("Signature:  valid")
+		return nil
+	},
+}
+
+// formatClaimTime shows a Unix time claim along with how far away it is.
+func formatClaimTime(unix int64) string {
+	if unix == 0 {
+		return "not set"
+	}
+	t := time.Unix(unix, 0)
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), -d)
+	}
+	return fmt.Sprintf("%s (in %s)", t.Format(time.RFC3339), d)
+}
+
+func init() {
+	tokenCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringSliceP("public", "k", nil, "Public key, JWKS file or directory of them to verify the token with")
+	inspectCmd.Flags().StringSlice("issuer", nil, "Require one of these issuers when verifying")
+	inspectCmd.Flags().StringSlice("audience", nil, "Require one of these audiences when verifying")
+}
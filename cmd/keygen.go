@@ -0,0 +1,198 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a keypair for signing and verifying tokens",
+	Long: `Generate an RSA, ECDSA or Ed25519 keypair. The private key is for
+token create and is only readable by its owner, the public key is for serve
+--public. Existing files are not overwritten without --force.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyType, _ := cmd.Flags().GetString("type")
+		bits, _ := cmd.Flags().GetInt("bits")
+		curveName, _ := cmd.Flags().GetString("curve")
+		privateFile, _ := cmd.Flags().GetString("private-key")
+		publicFile, _ := cmd.Flags().GetString("public-key")
+		jwksFile, _ := cmd.Flags().GetString("jwks")
+		force, _ := cmd.Flags().GetBool("force")
+
+		// Refuse before writing anything, so an existing public key isn't
+		// left next to a private key that doesn't match it
+		if !force {
+			for _, path := range []string{privateFile, publicFile, jwksFile} {
+				if _, err := os.Stat(path); path != "" && err == nil {
+					return fmt.Errorf("%s already exists, use --force to replace it", path)
+				}
+			}
+		}
+
+		var private crypto.Signer
+		var privateBlock *pem.Block
+		var err error
+		switch keyType {
+		case "rsa":
+			if bits < 2048 {
+				return errors.New("RSA keys need at least 2048 bits")
+			}
+			var key *rsa.PrivateKey
+			key, err = rsa.GenerateKey(rand.Reader, bits)
+			if err == nil {
+				private = key
+				privateBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+			}
+		case "ecdsa":
+			curves := map[string]elliptic.Curve{
+				"P-256": elliptic.P256(),
+				"P-384": elliptic.P384(),
+				"P-521": elliptic.P521(),
+			}
+			curve, ok := curves[strings.ToUpper(curveName)]
+			if !ok {
+				return fmt.Errorf("unknown curve %q, expected P-256, P-384 or P-521", curveName)
+			}
+			var key *ecdsa.PrivateKey
+			key, err = ecdsa.GenerateKey(curve, rand.Reader)
+			if err == nil {
+				private = key
+				var der []byte
+				der, err = x509.MarshalECPrivateKey(key)
+				privateBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+			}
+		case "ed25519":
+			var key ed25519.PrivateKey
+			_, key, err = ed25519.GenerateKey(rand.Reader)
+			if err == nil {
+				private = key
+				var der []byte
+				der, err = x509.MarshalPKCS8PrivateKey(key)
+				privateBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+			}
+		default:
+			return fmt.Errorf("unknown key type %q, expected rsa, ecdsa or ed25519", keyType)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to generate key: %s", err)
+		}
+		public, err := x509.MarshalPKIXPublicKey(private.Public())
+		if err != nil {
+			return fmt.Errorf("unable to encode public key: %s", err)
+		}
+
+		err = writeKeyFile(privateFile, pem.EncodeToMemory(privateBlock), 0600, force)
+		if err != nil {
+			return err
+		}
+		err = writeKeyFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644, force)
+		if err != nil {
+			if !force {
+				os.Remove(privateFile)
+			}
+			return err
+		}
+		fmt.Printf("Wrote %s and %s\n", privateFile, publicFile)
+
+		if jwksFile == "" {
+			return nil
+		}
+		jwk := jose.JSONWebKey{Key: private.Public(), Use: "sig"}
+		// The RFC 7638 thumbprint names the key without any coordination
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("unable to compute key ID: %s", err)
+		}
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+		algorithm, err := signingAlgorithm(private)
+		if err != nil {
+			return err
+		}
+		jwk.Algorithm = string(algorithm)
+		jwks, err := json.MarshalIndent(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to encode JWKS: %s", err)
+		}
+		err = writeKeyFile(jwksFile, append(jwks, '\n'), 0644, force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s, sign tokens with --kid %s\n", jwksFile, jwk.KeyID)
+		return nil
+	},
+}
+
+// writeKeyFile writes data to path with mode, refusing to replace an
+// existing file unless force is set.
+func writeKeyFile(path string, data []byte, mode os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, mode)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use --force to replace it", path)
+	} else if err != nil {
+		return err
+	}
+	// A replaced file keeps its old mode otherwise
+	err = file.Chmod(mode)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %s", path, err)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+
+	keygenCmd.Flags().StringP("type", "t", "rsa", "Key type, rsa, ecdsa or ed25519")
+	keygenCmd.Flags().Int("bits", 2048, "Size of an RSA key")
+	keygenCmd.Flags().String("curve", "P-256", "Curve of an ECDSA key, P-256, P-384 or P-521")
+	keygenCmd.Flags().String("private-key", "private.key", "File to write the private key to")
+	keygenCmd.Flags().String("public-key", "public.key", "File to write the public key to")
+	keygenCmd.Flags().String("jwks", "", "File to also write the public key to as a JWKS")
+	keygenCmd.Flags().Bool("force", false, "Replace existing files")
+}
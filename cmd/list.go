@@ -0,0 +1,106 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brimstone/traefik-cert/client"
+	"github.com/spf13/cobra"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List every certificate the server holds",
+	Long: `List the certificates served by a companion server, soonest to expire
+first. The token needs the admin claim, see token create --admin.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var o client.Options
+		o.URL, _ = cmd.Flags().GetString("url")
+		o.JWT, _ = cmd.Flags().GetString("jwt")
+		o.ClientCert, _ = cmd.Flags().GetString("client-cert")
+		o.ClientKey, _ = cmd.Flags().GetString("client-key")
+		o.Resolver, _ = cmd.Flags().GetString("resolver")
+		if o.ClientCert == "" {
+			o.ClientCert = os.Getenv("CLIENT_CERT")
+		}
+		if o.ClientKey == "" {
+			o.ClientKey = os.Getenv("CLIENT_KEY")
+		}
+		var filter client.ListFilter
+		filter.Domain, _ = cmd.Flags().GetString("domain")
+		filter.ExpiresWithin, _ = cmd.Flags().GetDuration("expires-within")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		certs, err := client.List(o, filter)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(certs)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tSANS\tRESOLVER\tISSUER\tEXPIRES\tSOURCE")
+		for _, cert := range certs {
+			expires := "unknown"
+			if !cert.NotAfter.IsZero() {
+				expires = cert.NotAfter.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				cert.Domain,
+				orDash(strings.Join(cert.SANs, ",")),
+				orDash(cert.Resolver),
+				orDash(cert.Issuer),
+				expires,
+				orDash(cert.Source),
+			)
+		}
+		return w.Flush()
+	},
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringP("url", "u", "", "Base URL for companion server [$URL]")
+	listCmd.Flags().StringP("jwt", "j", "", "JWT with the admin claim [$JWT]")
+	listCmd.Flags().String("client-cert", "", "Client cert to present to a server using mtls [$CLIENT_CERT]")
+	listCmd.Flags().String("client-key", "", "Key for --client-cert [$CLIENT_KEY]")
+	listCmd.Flags().StringP("resolver", "r", "", "Only list certs from this Traefik certificate resolver")
+	listCmd.Flags().StringP("domain", "d", "", "Only list certs for this domain or its subdomains")
+	listCmd.Flags().Duration("expires-within", 0, "Only list certs expiring within this long")
+	listCmd.Flags().Bool("json", false, "Print the certificates as JSON")
+}
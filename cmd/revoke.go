@@ -0,0 +1,90 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/brimstone/traefik-cert/server"
+	"github.com/brimstone/traefik-cert/types"
+	"github.com/spf13/cobra"
+)
+
+// revokeCmd represents the token revoke command
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Add a token to the revocation file used by serve",
+	Long: `Revoke a token by its jti, every token of a subject, or a token itself by
+its hash. The entry is appended to the revocation file, which serve reloads
+as soon as it changes.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, _ := cmd.Flags().GetString("file")
+		if file == "" {
+			file = os.Getenv("REVOCATIONS")
+		}
+		if file == "" {
+			return errors.New("a revocation file is required")
+		}
+		jti, _ := cmd.Flags().GetString("jti")
+		subject, _ := cmd.Flags().GetString("subject")
+		token, _ := cmd.Flags().GetString("token")
+		reason, _ := cmd.Flags().GetString("reason")
+
+		var kind, value string
+		switch {
+		case jti != "" && subject == "" && token == "":
+			kind, value = server.RevokeTokenID, jti
+		case subject != "" && jti == "" && token == "":
+			kind, value = server.RevokeSubject, subject
+		case token != "" && jti == "" && subject == "":
+			// Reading the token from stdin keeps it out of shell history
+			if token == "-" {
+				raw, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return err
+				}
+				token = string(raw)
+			}
+			kind, value = server.RevokeTokenHash, types.TokenHash(token)
+		default:
+			return errors.New("exactly one of --jti, --subject or --token is required")
+		}
+
+		err := server.AppendRevocation(file, kind, value, reason)
+		if err != nil {
+			return fmt.Errorf("unable to revoke: %s", err)
+		}
+		fmt.Printf("Revoked %s:%s\n", kind, value)
+		return nil
+	},
+}
+
+func init() {
+	tokenCmd.AddCommand(revokeCmd)
+
+	revokeCmd.Flags().StringP("file", "f", "", "Revocation file to append to [$REVOCATIONS]")
+	revokeCmd.Flags().String("jti", "", "Revoke the token with this ID")
+	revokeCmd.Flags().String("subject", "", "Revoke every token for this subject")
+	revokeCmd.Flags().String("token", "", "Revoke this token, - to read it from stdin")
+	revokeCmd.Flags().String("reason", "", "Note recorded with the entry")
+}
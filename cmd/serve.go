@@ -19,6 +19,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"time"
+
 	"github.com/brimstone/traefik-cert/server"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -35,10 +37,53 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		keys := viper.GetStringSlice("public")
+		// The default key file is only wanted when no JWKS URL replaces it
+		if viper.GetString("jwks-url") != "" && !viper.IsSet("public") {
+			keys = nil
+		}
+		acme := viper.GetStringSlice("acme")
+		// The default ACME file is only wanted when no other source is given
+		others := len(viper.GetStringSlice("pem-dir")) + len(viper.GetStringSlice("certbot-dir")) + len(viper.GetStringSlice("traefik-file"))
+		if others > 0 && !viper.IsSet("acme") {
+			acme = nil
+		}
 		s, err := server.NewServer(server.ServerOptions{
-			Address:  viper.GetString("address"),
-			Key:      viper.GetString("public"),
-			AcmeFile: viper.GetString("acme"),
+			Address:        viper.GetString("address"),
+			MetricsAddress: viper.GetString("metrics-address"),
+			Keys:           keys,
+			JWKSURL:        viper.GetString("jwks-url"),
+			JWKSRefresh:    viper.GetDuration("jwks-refresh"),
+			AcmeFiles:      acme,
+			PEMDirs:        viper.GetStringSlice("pem-dir"),
+			CertbotDirs:    viper.GetStringSlice("certbot-dir"),
+			FileProviders:  viper.GetStringSlice("traefik-file"),
+			AuditLog:       viper.GetString("audit-log"),
+			Auth:           viper.GetStringSlice("auth"),
+			ClientCA:       viper.GetString("client-ca"),
+			ClientMap:      viper.GetString("client-map"),
+			ExpiryWarning:  viper.GetDuration("expiry-warning"),
+			RateToken:      viper.GetFloat64("rate-token"),
+			RateTokenBurst: viper.GetInt("rate-token-burst"),
+			RateIP:         viper.GetFloat64("rate-ip"),
+			RateIPBurst:    viper.GetInt("rate-ip-burst"),
+			TrustedProxies: viper.GetStringSlice("trusted-proxy"),
+			Policy:         viper.GetString("policy"),
+			PolicyDryRun:   viper.GetBool("policy-dry-run"),
+			Revocations:    viper.GetString("revocations"),
+			TLSDomain:      viper.GetString("tls-domain"),
+			TLSCert:        viper.GetString("tls-cert"),
+			TLSKey:         viper.GetString("tls-key"),
+			WebhookURLs:    viper.GetStringSlice("webhook"),
+			WebhookSecret:  viper.GetString("webhook-secret"),
+			WebhookQueue:   viper.GetString("webhook-queue"),
+			Tokens: server.TokenRules{
+				Algorithms:  viper.GetStringSlice("token-algorithms"),
+				Issuers:     viper.GetStringSlice("issuer"),
+				Audiences:   viper.GetStringSlice("audience"),
+				MaxLifetime: viper.GetDuration("max-token-lifetime"),
+				ClockSkew:   viper.GetDuration("clock-skew"),
+			},
 		})
 		if err != nil {
 			return err
@@ -54,11 +99,131 @@ func init() {
 	viper.BindPFlag("address", serveCmd.Flags().Lookup("address"))
 	viper.BindEnv("address")
 
-	serveCmd.Flags().StringP("public", "k", "public.key", "Key to use to validate requests [$PUBLIC]")
+	serveCmd.Flags().String("metrics-address", "", "Address on which to serve /metrics instead of --address [$METRICS_ADDRESS]")
+	viper.BindPFlag("metrics-address", serveCmd.Flags().Lookup("metrics-address"))
+	viper.BindEnv("metrics-address", "METRICS_ADDRESS")
+
+	serveCmd.Flags().StringSliceP("public", "k", []string{"public.key"}, "Public key, JWKS file or directory of them to validate requests [$PUBLIC]")
 	viper.BindPFlag("public", serveCmd.Flags().Lookup("public"))
 	viper.BindEnv("public")
 
-	serveCmd.Flags().StringP("acme", "f", "/acme/acme.json", "Path to ACME JSON [$ACME]")
+	serveCmd.Flags().StringSliceP("acme", "f", []string{"/acme/acme.json"}, "Path or glob of ACME JSON, may be repeated [$ACME]")
 	viper.BindPFlag("acme", serveCmd.Flags().Lookup("acme"))
 	viper.BindEnv("acme")
+
+	serveCmd.Flags().String("tls-domain", "", "Serve HTTPS with the cert for this domain from the served certs [$TLS_DOMAIN]")
+	viper.BindPFlag("tls-domain", serveCmd.Flags().Lookup("tls-domain"))
+	viper.BindEnv("tls-domain", "TLS_DOMAIN")
+
+	serveCmd.Flags().String("tls-cert", "", "Serve HTTPS with the cert in this file [$TLS_CERT]")
+	viper.BindPFlag("tls-cert", serveCmd.Flags().Lookup("tls-cert"))
+	viper.BindEnv("tls-cert", "TLS_CERT")
+
+	serveCmd.Flags().String("tls-key", "", "Key file for --tls-cert [$TLS_KEY]")
+	viper.BindPFlag("tls-key", serveCmd.Flags().Lookup("tls-key"))
+	viper.BindEnv("tls-key", "TLS_KEY")
+
+	serveCmd.Flags().StringSlice("auth", []string{server.AuthJWT}, "Authentication methods to accept, jwt and/or mtls [$AUTH]")
+	viper.BindPFlag("auth", serveCmd.Flags().Lookup("auth"))
+	viper.BindEnv("auth")
+
+	serveCmd.Flags().String("client-ca", "", "CA bundle for verifying client certs with mtls [$CLIENT_CA]")
+	viper.BindPFlag("client-ca", serveCmd.Flags().Lookup("client-ca"))
+	viper.BindEnv("client-ca", "CLIENT_CA")
+
+	serveCmd.Flags().String("client-map", "", "YAML map of client cert subject or SAN to domains with mtls [$CLIENT_MAP]")
+	viper.BindPFlag("client-map", serveCmd.Flags().Lookup("client-map"))
+	viper.BindEnv("client-map", "CLIENT_MAP")
+
+	serveCmd.Flags().Duration("expiry-warning", 14*24*time.Hour, "Report certs as expiring this long before they expire [$EXPIRY_WARNING]")
+	viper.BindPFlag("expiry-warning", serveCmd.Flags().Lookup("expiry-warning"))
+	viper.BindEnv("expiry-warning", "EXPIRY_WARNING")
+
+	serveCmd.Flags().StringSlice("webhook", nil, "URL to POST to when a cert is added, renewed or removed [$WEBHOOK]")
+	viper.BindPFlag("webhook", serveCmd.Flags().Lookup("webhook"))
+	viper.BindEnv("webhook")
+
+	serveCmd.Flags().String("webhook-secret", "", "Secret for signing webhook deliveries [$WEBHOOK_SECRET]")
+	viper.BindPFlag("webhook-secret", serveCmd.Flags().Lookup("webhook-secret"))
+	viper.BindEnv("webhook-secret", "WEBHOOK_SECRET")
+
+	serveCmd.Flags().String("webhook-queue", "", "File keeping undelivered webhooks across restarts [$WEBHOOK_QUEUE]")
+	viper.BindPFlag("webhook-queue", serveCmd.Flags().Lookup("webhook-queue"))
+	viper.BindEnv("webhook-queue", "WEBHOOK_QUEUE")
+
+	serveCmd.Flags().String("audit-log", "", "File to append a JSON line to for every key released [$AUDIT_LOG]")
+	viper.BindPFlag("audit-log", serveCmd.Flags().Lookup("audit-log"))
+	viper.BindEnv("audit-log", "AUDIT_LOG")
+
+	serveCmd.Flags().Float64("rate-token", 0, "Requests a minute to /cert/ and /watch/ allowed for each token, 0 for no limit [$RATE_TOKEN]")
+	viper.BindPFlag("rate-token", serveCmd.Flags().Lookup("rate-token"))
+	viper.BindEnv("rate-token", "RATE_TOKEN")
+
+	serveCmd.Flags().Int("rate-token-burst", 5, "Requests each token may make at once above --rate-token [$RATE_TOKEN_BURST]")
+	viper.BindPFlag("rate-token-burst", serveCmd.Flags().Lookup("rate-token-burst"))
+	viper.BindEnv("rate-token-burst", "RATE_TOKEN_BURST")
+
+	serveCmd.Flags().Float64("rate-ip", 0, "Requests a minute to /cert/ and /watch/ allowed for each client address, 0 for no limit [$RATE_IP]")
+	viper.BindPFlag("rate-ip", serveCmd.Flags().Lookup("rate-ip"))
+	viper.BindEnv("rate-ip", "RATE_IP")
+
+	serveCmd.Flags().Int("rate-ip-burst", 20, "Requests each client address may make at once above --rate-ip [$RATE_IP_BURST]")
+	viper.BindPFlag("rate-ip-burst", serveCmd.Flags().Lookup("rate-ip-burst"))
+	viper.BindEnv("rate-ip-burst", "RATE_IP_BURST")
+
+	serveCmd.Flags().StringSlice("trusted-proxy", nil, "Proxy address or CIDR whose X-Forwarded-For is trusted [$TRUSTED_PROXY]")
+	viper.BindPFlag("trusted-proxy", serveCmd.Flags().Lookup("trusted-proxy"))
+	viper.BindEnv("trusted-proxy", "TRUSTED_PROXY")
+
+	serveCmd.Flags().String("revocations", "", "File of revoked tokens, reloaded when it changes [$REVOCATIONS]")
+	viper.BindPFlag("revocations", serveCmd.Flags().Lookup("revocations"))
+	viper.BindEnv("revocations")
+
+	serveCmd.Flags().String("jwks-url", "", "URL of a JWKS with further keys to validate requests [$JWKS_URL]")
+	viper.BindPFlag("jwks-url", serveCmd.Flags().Lookup("jwks-url"))
+	viper.BindEnv("jwks-url", "JWKS_URL")
+
+	serveCmd.Flags().Duration("jwks-refresh", 15*time.Minute, "How long to cache keys from --jwks-url [$JWKS_REFRESH]")
+	viper.BindPFlag("jwks-refresh", serveCmd.Flags().Lookup("jwks-refresh"))
+	viper.BindEnv("jwks-refresh", "JWKS_REFRESH")
+
+	serveCmd.Flags().String("policy", "", "YAML file capping the domains each subject or issuer may fetch [$POLICY]")
+	viper.BindPFlag("policy", serveCmd.Flags().Lookup("policy"))
+	viper.BindEnv("policy")
+
+	serveCmd.Flags().Bool("policy-dry-run", false, "Only log requests --policy would deny [$POLICY_DRY_RUN]")
+	viper.BindPFlag("policy-dry-run", serveCmd.Flags().Lookup("policy-dry-run"))
+	viper.BindEnv("policy-dry-run", "POLICY_DRY_RUN")
+
+	serveCmd.Flags().StringSlice("issuer", nil, "Accept only tokens with one of these iss claims [$ISSUER]")
+	viper.BindPFlag("issuer", serveCmd.Flags().Lookup("issuer"))
+	viper.BindEnv("issuer")
+
+	serveCmd.Flags().StringSlice("audience", nil, "Accept only tokens with one of these in their aud claim [$AUDIENCE]")
+	viper.BindPFlag("audience", serveCmd.Flags().Lookup("audience"))
+	viper.BindEnv("audience")
+
+	serveCmd.Flags().Duration("max-token-lifetime", 0, "Refuse tokens valid for longer than this, 0 for no limit [$MAX_TOKEN_LIFETIME]")
+	viper.BindPFlag("max-token-lifetime", serveCmd.Flags().Lookup("max-token-lifetime"))
+	viper.BindEnv("max-token-lifetime", "MAX_TOKEN_LIFETIME")
+
+	serveCmd.Flags().Duration("clock-skew", time.Minute, "Tolerance for clock differences when checking exp, nbf and iat [$CLOCK_SKEW]")
+	viper.BindPFlag("clock-skew", serveCmd.Flags().Lookup("clock-skew"))
+	viper.BindEnv("clock-skew", "CLOCK_SKEW")
+
+	serveCmd.Flags().StringSlice("token-algorithms", server.DefaultAlgorithms, "Signature algorithms accepted on tokens [$TOKEN_ALGORITHMS]")
+	viper.BindPFlag("token-algorithms", serveCmd.Flags().Lookup("token-algorithms"))
+	viper.BindEnv("token-algorithms", "TOKEN_ALGORITHMS")
+
+	serveCmd.Flags().StringSlice("pem-dir", nil, "Directory of NAME.key and NAME.crt pairs to serve certs from [$PEM_DIR]")
+	viper.BindPFlag("pem-dir", serveCmd.Flags().Lookup("pem-dir"))
+	viper.BindEnv("pem-dir", "PEM_DIR")
+
+	serveCmd.Flags().StringSlice("certbot-dir", nil, "Certbot live directory to serve certs from, such as /etc/letsencrypt/live [$CERTBOT_DIR]")
+	viper.BindPFlag("certbot-dir", serveCmd.Flags().Lookup("certbot-dir"))
+	viper.BindEnv("certbot-dir", "CERTBOT_DIR")
+
+	serveCmd.Flags().StringSlice("traefik-file", nil, "Traefik file provider YAML, or directory of it, to serve the tls.certificates of [$TRAEFIK_FILE]")
+	viper.BindPFlag("traefik-file", serveCmd.Flags().Lookup("traefik-file"))
+	viper.BindEnv("traefik-file", "TRAEFIK_FILE")
 }
@@ -0,0 +1,168 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+// acmeSource serves the certificates Traefik keeps in acme.json.
+type acmeSource struct {
+	path string
+}
+
+// NewAcmeSource returns a source reading the certificates of every
+// resolver in a Traefik acme.json file.
+func NewAcmeSource(path string) CertificateSource {
+	return &acmeSource{path: path}
+}
+
+func (a *acmeSource) Name() string {
+	return a.path
+}
+
+func (a *acmeSource) Load() ([]Certificate, error) {
+	raw, err := os.ReadFile(a.path)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseAcme(raw)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]Certificate, 0, len(parsed))
+	for _, c := range parsed {
+		// A certificate that doesn't decode is left empty, and skipped by
+		// the store
+		cert, _ := base64.StdEncoding.DecodeString(c.Certificate)
+		key, _ := base64.StdEncoding.DecodeString(c.Key)
+		certs = append(certs, Certificate{
+			Main:     c.Domain.Main,
+			SANs:     c.Domain.SANs,
+			Resolver: c.Resolver,
+			Cert:     cert,
+			Key:      key,
+		})
+	}
+	return certs, nil
+}
+
+func (a *acmeSource) Watch(logger *logger.Logger, onChange func()) (io.Closer, error) {
+	watcher, err := watchFile(a.path, logger, onChange)
+	if err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// expandAcmeFiles expands the glob patterns among paths, keeping each file
+// once. Paths without a pattern are kept even if they don't exist yet, but
+// a pattern matching nothing is an error.
+func expandAcmeFiles(paths []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		matches := []string{path}
+		if strings.ContainsAny(path, "*?[") {
+			var err error
+			matches, err = filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACME file pattern %s: %s", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no ACME files match %s", path)
+			}
+		}
+		for _, match := range matches {
+			if !seen[filepath.Clean(match)] {
+				seen[filepath.Clean(match)] = true
+				files = append(files, match)
+			}
+		}
+	}
+	return files, nil
+}
+
+// acmeCertificate is a certificate from acme.json along with the name of
+// the resolver that obtained it. Certificates from a Traefik v1 file have
+// no resolver.
+type acmeCertificate struct {
+	types.AcmeCertificate
+	Resolver string
+}
+
+// parseAcme reads either acme.json layout and returns the certificates of
+// every resolver in it. Traefik v1 keeps Account and Certificates at the top
+// level, while v2 and later nest them under each resolver's name.
+func parseAcme(raw []byte) ([]acmeCertificate, error) {
+	var top map[string]json.RawMessage
+	err := json.Unmarshal(raw, &top)
+	if err != nil {
+		return nil, err
+	}
+
+	_, hasAccount := top["Account"]
+	_, hasCertificates := top["Certificates"]
+	if hasAccount || hasCertificates {
+		var v1 types.Acme
+		err = json.Unmarshal(raw, &v1)
+		if err != nil {
+			return nil, err
+		}
+		certs := make([]acmeCertificate, 0, len(v1.Certificates))
+		for _, c := range v1.Certificates {
+			certs = append(certs, acmeCertificate{AcmeCertificate: c})
+		}
+		return certs, nil
+	}
+
+	var v2 types.AcmeV2
+	err = json.Unmarshal(raw, &v2)
+	if err != nil {
+		return nil, err
+	}
+	// Walk resolvers in a stable order so the first match doesn't depend
+	// on map iteration
+	resolvers := make([]string, 0, len(v2))
+	for name := range v2 {
+		resolvers = append(resolvers, name)
+	}
+	sort.Strings(resolvers)
+
+	var certs []acmeCertificate
+	for _, name := range resolvers {
+		for _, c := range v2[name].Certificates {
+			certs = append(certs, acmeCertificate{
+				AcmeCertificate: c,
+				Resolver:        name,
+			})
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,115 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAcme(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []acmeCertificate
+		wantErr bool
+	}{
+		{
+			name: "v1",
+			raw: `{
+				"Account": {"Email": "admin@example.com"},
+				"Certificates": [
+					{"Domain": {"Main": "example.com", "SANs": ["www.example.com"]}, "Certificate": "Y2VydA==", "Key": "a2V5"}
+				]
+			}`,
+			want: []acmeCertificate{
+				{Resolver: ""},
+			},
+		},
+		{
+			name: "v1 without an account",
+			raw:  `{"Certificates": [{"Domain": {"Main": "example.com"}}]}`,
+			want: []acmeCertificate{
+				{Resolver: ""},
+			},
+		},
+		{
+			name: "v2 resolvers in name order",
+			raw: `{
+				"zerossl": {"Account": null, "Certificates": [{"domain": {"main": "b.example.com"}, "certificate": "Y2VydA==", "key": "a2V5", "Store": "default"}]},
+				"le": {"Account": {"Email": "admin@example.com"}, "Certificates": [
+					{"domain": {"main": "a.example.com", "sans": ["c.example.com"]}, "certificate": "Y2VydA==", "key": "a2V5"}
+				]}
+			}`,
+			want: []acmeCertificate{
+				{Resolver: "le"},
+				{Resolver: "zerossl"},
+			},
+		},
+		{
+			name: "v2 resolver without certificates",
+			raw:  `{"le": {"Account": null, "Certificates": null}}`,
+			want: nil,
+		},
+		{
+			name:    "not JSON",
+			raw:     `not json`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong shape",
+			raw:     `{"le": []}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAcme([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAcme() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseAcme() returned %d certificates, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i].Resolver != tt.want[i].Resolver {
+					t.Errorf("certificate %d resolver = %q, want %q", i, got[i].Resolver, tt.want[i].Resolver)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAcmeFields(t *testing.T) {
+	v1 := `{"Account": {}, "Certificates": [{"Domain": {"Main": "example.com", "SANs": ["www.example.com"]}, "Certificate": "Y2VydA==", "Key": "a2V5"}]}`
+	v2 := `{"le": {"Certificates": [{"domain": {"main": "example.com", "sans": ["www.example.com"]}, "certificate": "Y2VydA==", "key": "a2V5"}]}}`
+	for name, raw := range map[string]string{"v1": v1, "v2": v2} {
+		certs, err := parseAcme([]byte(raw))
+		if err != nil || len(certs) != 1 {
+			t.Fatalf("%s: parseAcme() = %v, %v", name, certs, err)
+		}
+		c := certs[0]
+		if c.Domain.Main != "example.com" || !reflect.DeepEqual(c.Domain.SANs, []string{"www.example.com"}) {
+			t.Errorf("%s: domain = %+v", name, c.Domain)
+		}
+		if c.Certificate != "Y2VydA==" || c.Key != "a2V5" {
+			t.Errorf("%s: certificate %q and key %q", name, c.Certificate, c.Key)
+		}
+	}
+}
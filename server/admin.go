@@ -0,0 +1,111 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brimstone/traefik-cert/types"
+)
+
+// listCerts describes every certificate held to a client with the admin
+// claim, soonest to expire first. The domain query parameter keeps
+// certificates for that domain or its subdomains, expires_within keeps
+// those expiring within a duration, and resolver keeps one resolver's.
+func listCerts(auth *authenticator, store *certStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, ok := requireIdentity(auth, w, r)
+		if !ok {
+			return
+		}
+		if !id.Admin {
+			auth.failed("not_admin")
+			annotate(r).Error = "token lacks the admin claim"
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+
+		query := r.URL.Query()
+		suffix := normalizeDomain(query.Get("domain"))
+		resolver := query.Get("resolver")
+		var deadline time.Time
+		if within := query.Get("expires_within"); within != "" {
+			d, err := time.ParseDuration(within)
+			if err != nil {
+				http.Error(w, "Invalid expires_within", http.StatusBadRequest)
+				return
+			}
+			deadline = time.Now().Add(d)
+		}
+
+		response := types.CertListResponse{Certificates: []types.CertInfo{}}
+		for _, entry := range store.current().entries {
+			if resolver != "" && entry.Resolver != resolver {
+				continue
+			}
+			if suffix != "" && !coversSuffix(entry.Domains(), suffix) {
+				continue
+			}
+			if !deadline.IsZero() && entry.NotAfter().After(deadline) {
+				continue
+			}
+			info, err := certInfo(entry)
+			if err != nil {
+				// Still worth listing, even without the details
+				info = types.CertInfo{
+					Domain:   entry.Main,
+					SANs:     entry.SANs,
+					Resolver: entry.Resolver,
+					Source:   entry.Source,
+				}
+			}
+			response.Certificates = append(response.Certificates, info)
+		}
+		sort.SliceStable(response.Certificates, func(i, j int) bool {
+			return response.Certificates[i].NotAfter.Before(response.Certificates[j].NotAfter)
+		})
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(response)
+		}
+	})
+}
+
+// coversSuffix reports whether any of domains is suffix or a subdomain of
+// it.
+func coversSuffix(domains []string, suffix string) bool {
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
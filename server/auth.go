@@ -0,0 +1,341 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brimstone/traefik-cert/types"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// AuthJWT authenticates clients by a bearer token signed by the
+	// configured key.
+	AuthJWT = "jwt"
+	// AuthMTLS authenticates clients by a certificate issued by the
+	// configured CA.
+	AuthMTLS = "mtls"
+)
+
+// identity is an authenticated client and the domains it may fetch.
+type identity struct {
+	// Method is the authenticator that accepted the client.
+	Method  string
+	Subject string
+	// Issuer is the iss of a token, or the issuer of a client certificate.
+	Issuer string
+	// TokenID is the jti of the bearer token, if it had one.
+	TokenID string
+	// TokenHash is the types.TokenHash of the bearer token.
+	TokenHash string
+	// Admin may use the admin API.
+	Admin bool
+	// Expires is when the token or client certificate stops being valid,
+	// or zero if it never does.
+	Expires time.Time
+	// Domains may be fetched with their private keys.
+	Domains []string
+	// InfoDomains may only have their metadata inspected.
+	InfoDomains []string
+}
+
+// authError is an authentication failure. Message is safe to send to the
+// client, Reason is a short label for metrics, and Err holds the detail for
+// the log.
+type authError struct {
+	Status  int
+	Message string
+	Reason  string
+	Err     error
+}
+
+func (e *authError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+// authenticator checks each request against the enabled methods. When both
+// are enabled a mapped client certificate is accepted first and a bearer
+// token is the fallback.
+type authenticator struct {
+	jwt  bool
+	mtls bool
+	// keys verify bearer tokens, when jwt is enabled.
+	keys *keyring
+	// rules are checked against the claims of bearer tokens.
+	rules TokenRules
+	// clients maps a client certificate's subject or SAN to the domains
+	// it may fetch.
+	clients map[string][]string
+	// revocations refuses revoked tokens and subjects, when set.
+	revocations *revocations
+	// policy caps the domains clients may fetch, when set.
+	policy *policy
+	// metrics counts failures, when set.
+	metrics *metrics
+}
+
+func newAuthenticator(methods []string, clientMap string) (*authenticator, error) {
+	a := &authenticator{}
+	// Methods from the environment arrive as a single comma separated value
+	for _, method := range strings.Split(strings.Join(methods, ","), ",") {
+		switch strings.TrimSpace(method) {
+		case AuthJWT:
+			a.jwt = true
+		case AuthMTLS:
+			a.mtls = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	if !a.jwt && !a.mtls {
+		return nil, errors.New("at least one authentication method must be enabled")
+	}
+	if a.mtls {
+		if clientMap == "" {
+			return nil, errors.New("mutual TLS requires a client map")
+		}
+		raw, err := os.ReadFile(clientMap)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client map: %s", err)
+		}
+		err = yaml.Unmarshal(raw, &a.clients)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client map: %s", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *authenticator) authenticate(r *http.Request) (*identity, error) {
+	id, err := a.identify(r)
+	if err != nil {
+		return nil, err
+	}
+	err = a.recheck(id)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// recheck repeats the checks a client can fail after authenticating, so
+// long-lived requests end once its token is revoked or it expires.
+func (a *authenticator) recheck(id *identity) error {
+	if a.revocations != nil {
+		if entry := a.revocations.revoked(id); entry != "" {
+			return &authError{
+				Status:  http.StatusUnauthorized,
+				Message: "Token revoked",
+				Reason:  "revoked_token",
+				Err:     fmt.Errorf("%s matched %s", id.Subject, entry),
+			}
+		}
+	}
+	if !id.Expires.IsZero() && time.Now().After(id.Expires.Add(a.rules.ClockSkew)) {
+		return &authError{
+			Status:  http.StatusUnauthorized,
+			Message: "Credentials expired",
+			Reason:  "token_expired",
+			Err:     fmt.Errorf("%s expired at %s", id.Subject, id.Expires.Format(time.RFC3339)),
+		}
+	}
+	return nil
+}
+
+// expiry returns a channel that fires once recheck would find the client
+// expired, or nil if it never will.
+func (a *authenticator) expiry(id *identity) <-chan time.Time {
+	if id.Expires.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(id.Expires.Add(a.rules.ClockSkew)) + time.Second)
+}
+
+// identify finds who made the request, without checking revocations.
+func (a *authenticator) identify(r *http.Request) (*identity, error) {
+	if a.mtls && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		id := a.clientCertificate(r.TLS.VerifiedChains[0][0])
+		if id != nil {
+			return id, nil
+		}
+		if !a.jwt {
+			return nil, &authError{
+				Status:  http.StatusUnauthorized,
+				Message: "Unauthorized client certificate",
+				Reason:  "unmapped_client_certificate",
+				Err:     errors.New(r.TLS.VerifiedChains[0][0].Subject.String()),
+			}
+		}
+	}
+	if !a.jwt {
+		return nil, &authError{
+			Status:  http.StatusUnauthorized,
+			Message: "Expected client certificate",
+			Reason:  "missing_credentials",
+		}
+	}
+	return a.bearer(r)
+}
+
+// clientCertificate returns the identity mapped to any of the certificate's
+// names, or nil if none of them are mapped.
+func (a *authenticator) clientCertificate(cert *x509.Certificate) *identity {
+	names := []string{cert.Subject.String(), cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	var id *identity
+	for _, name := range names {
+		domains, ok := a.clients[name]
+		if !ok {
+			continue
+		}
+		if id == nil {
+			id = &identity{
+				Method:  AuthMTLS,
+				Subject: cert.Subject.String(),
+				Issuer:  cert.Issuer.String(),
+				Expires: cert.NotAfter,
+			}
+		}
+		id.Domains = append(id.Domains, domains...)
+	}
+	return id
+}
+
+func (a *authenticator) bearer(r *http.Request) (*identity, error) {
+	// Check for empty JWT
+	clientToken := r.Header.Get("Authorization")
+	if clientToken == "" {
+		return nil, &authError{
+			Status:  http.StatusBadRequest,
+			Message: "Expected authorization",
+			Reason:  "missing_credentials",
+		}
+	}
+	// Check for Bearer
+	if !strings.HasPrefix(clientToken, "Bearer ") {
+		return nil, &authError{
+			Status:  http.StatusBadRequest,
+			Message: "Authorization in the wrong form.",
+			Reason:  "malformed_authorization",
+		}
+	}
+	clientToken = strings.TrimPrefix(clientToken, "Bearer ")
+
+	payload, err := a.keys.verify(clientToken, a.rules.Algorithms)
+	if err != nil {
+		reason := "invalid_token"
+		var tokenErr *tokenError
+		if errors.As(err, &tokenErr) {
+			reason = tokenErr.Reason
+		}
+		return nil, &authError{
+			Status:  http.StatusUnauthorized,
+			Message: "Authorization failed",
+			Reason:  reason,
+			Err:     fmt.Errorf("token %s: %s", redactToken(clientToken), err),
+		}
+	}
+	clientPayload, tokenErr := a.rules.check(payload, time.Now())
+	if tokenErr != nil {
+		return nil, &authError{
+			Status:  http.StatusUnauthorized,
+			Message: "Authorization failed",
+			Reason:  tokenErr.Reason,
+			Err:     fmt.Errorf("token %s: %s", redactToken(clientToken), tokenErr),
+		}
+	}
+	return &identity{
+		Method:      AuthJWT,
+		Subject:     clientPayload.Subject,
+		Issuer:      clientPayload.Issuer,
+		TokenID:     clientPayload.ID,
+		TokenHash:   types.TokenHash(clientToken),
+		Admin:       clientPayload.Admin,
+		Expires:     time.Unix(clientPayload.Expires, 0),
+		Domains:     clientPayload.Cert.Domains,
+		InfoDomains: clientPayload.Cert.Info,
+	}, nil
+}
+
+// permitted applies the policy to a domain the client was granted. A denial
+// is recorded in the request log, and in dry run mode only recorded.
+func (a *authenticator) permitted(r *http.Request, id *identity, domain string) bool {
+	if a.policy == nil {
+		return true
+	}
+	return a.enforce(r, a.policy.check(id, domain))
+}
+
+// servable applies the policy's denials to every name of the certificate
+// about to be served for a permitted domain.
+func (a *authenticator) servable(r *http.Request, id *identity, entry *certEntry) bool {
+	if a.policy == nil {
+		return true
+	}
+	return a.enforce(r, a.policy.checkServed(id, entry.Domains()))
+}
+
+// enforce refuses the request if the policy gave a reason, recording it in
+// the request log. In dry run mode it's only recorded.
+func (a *authenticator) enforce(r *http.Request, reason string) bool {
+	if reason == "" {
+		return true
+	}
+	if a.policy.dryRun {
+		annotate(r).Policy = "would deny: " + reason
+		return true
+	}
+	annotate(r).Policy = "denied: " + reason
+	a.failed("policy_denied")
+	return false
+}
+
+// visible is permitted without the logging, for filtering what a client
+// is told about.
+func (a *authenticator) visible(id *identity, domain string) bool {
+	return a.policy == nil || a.policy.dryRun || a.policy.check(id, domain) == ""
+}
+
+// failed records a refused request in the metrics.
+func (a *authenticator) failed(reason string) {
+	if a.metrics != nil {
+		a.metrics.authFailed(reason)
+	}
+}
+
+// redactToken identifies a token in logs without revealing it.
+func redactToken(token string) string {
+	return "sha256:" + types.TokenHash(token)[:12]
+}
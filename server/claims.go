@@ -0,0 +1,118 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/brimstone/traefik-cert/types"
+)
+
+// TokenRules are the checks a token's claims must pass once its signature
+// is verified.
+type TokenRules struct {
+	// Algorithms are the signature algorithms accepted, DefaultAlgorithms
+	// when empty. none never is.
+	Algorithms []string
+	// Issuers, when set, are the only iss values accepted.
+	Issuers []string
+	// Audiences, when set, must include one of the token's aud values, so
+	// a token signed for another service with the same key is refused.
+	Audiences []string
+	// MaxLifetime, when set, is the longest a token may be valid for,
+	// counted from its iat, and the furthest its exp may be from now.
+	MaxLifetime time.Duration
+	// ClockSkew is tolerated on exp, nbf and iat.
+	ClockSkew time.Duration
+}
+
+// tokenError is a token refused for its claims. Reason names the failed
+// check for the logs and metrics.
+type tokenError struct {
+	Reason string
+	Err    error
+}
+
+func (e *tokenError) Error() string {
+	return e.Err.Error()
+}
+
+func refuse(reason string, format string, args ...interface{}) *tokenError {
+	return &tokenError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// check decodes the claims in a verified payload and applies the rules.
+func (t TokenRules) check(payload []byte, now time.Time) (*types.Auth, *tokenError) {
+	var claims types.Auth
+	err := json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, refuse("malformed_claims", "unable to decode claims: %s", err)
+	}
+
+	if claims.Expires == 0 {
+		return nil, refuse("missing_exp", "token has no exp")
+	}
+	exp := time.Unix(claims.Expires, 0)
+	if now.After(exp.Add(t.ClockSkew)) {
+		return nil, refuse("token_expired", "token isn't valid after %s", exp)
+	}
+	if claims.NotBefore != 0 {
+		nbf := time.Unix(claims.NotBefore, 0)
+		if now.Before(nbf.Add(-t.ClockSkew)) {
+			return nil, refuse("token_not_yet_valid", "token isn't valid until %s", nbf)
+		}
+	}
+	if t.MaxLifetime > 0 {
+		if exp.Sub(now) > t.MaxLifetime+t.ClockSkew {
+			return nil, refuse("token_lifetime_exceeded", "token expires %s, more than %s from now", exp, t.MaxLifetime)
+		}
+		if claims.IssuedAt != 0 && exp.Sub(time.Unix(claims.IssuedAt, 0)) > t.MaxLifetime {
+			return nil, refuse("token_lifetime_exceeded", "token is valid for %s, more than %s", exp.Sub(time.Unix(claims.IssuedAt, 0)), t.MaxLifetime)
+		}
+	}
+
+	if len(t.Issuers) > 0 && !contains(t.Issuers, claims.Issuer) {
+		return nil, refuse("wrong_issuer", "issuer %q is not accepted", claims.Issuer)
+	}
+	if len(t.Audiences) > 0 {
+		accepted := false
+		for _, audience := range claims.Audience {
+			if contains(t.Audiences, audience) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return nil, refuse("wrong_audience", "audience %q is not accepted", strings.Join(claims.Audience, ","))
+		}
+	}
+	return &claims, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenRulesCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) int64 {
+		return now.Add(d).Unix()
+	}
+	strict := TokenRules{
+		Issuers:     []string{"traefik-cert"},
+		Audiences:   []string{"certs"},
+		MaxLifetime: 24 * time.Hour,
+		ClockSkew:   time.Minute,
+	}
+	tests := []struct {
+		name    string
+		rules   TokenRules
+		payload string
+		reason  string
+	}{
+		{
+			name:    "valid",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"sub":"web","iss":"traefik-cert","aud":"certs","iat":%d,"exp":%d}`, at(-time.Hour), at(time.Hour)),
+		},
+		{
+			name:    "audience list",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":["other","certs"],"exp":%d}`, at(time.Hour)),
+		},
+		{
+			name:    "no rules",
+			payload: fmt.Sprintf(`{"exp":%d}`, at(365*24*time.Hour)),
+		},
+		{
+			name:    "malformed",
+			payload: `{"exp":"soon"}`,
+			reason:  "malformed_claims",
+		},
+		{
+			name:    "missing exp",
+			payload: `{"sub":"web"}`,
+			reason:  "missing_exp",
+		},
+		{
+			name:    "expired",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":"certs","exp":%d}`, at(-2*time.Minute)),
+			reason:  "token_expired",
+		},
+		{
+			name:    "expired within skew",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":"certs","exp":%d}`, at(-30*time.Second)),
+		},
+		{
+			name:    "not yet valid",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":"certs","nbf":%d,"exp":%d}`, at(2*time.Minute), at(time.Hour)),
+			reason:  "token_not_yet_valid",
+		},
+		{
+			name:    "not yet valid within skew",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":"certs","nbf":%d,"exp":%d}`, at(30*time.Second), at(time.Hour)),
+		},
+		{
+			name:    "exp too far away",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":"certs","exp":%d}`, at(48*time.Hour)),
+			reason:  "token_lifetime_exceeded",
+		},
+		{
+			name:    "issued for too long",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":"certs","iat":%d,"exp":%d}`, at(-47*time.Hour), at(time.Hour)),
+			reason:  "token_lifetime_exceeded",
+		},
+		{
+			name:    "wrong issuer",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"someone","aud":"certs","exp":%d}`, at(time.Hour)),
+			reason:  "wrong_issuer",
+		},
+		{
+			name:    "missing issuer",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"aud":"certs","exp":%d}`, at(time.Hour)),
+			reason:  "wrong_issuer",
+		},
+		{
+			name:    "wrong audience",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","aud":["other"],"exp":%d}`, at(time.Hour)),
+			reason:  "wrong_audience",
+		},
+		{
+			name:    "missing audience",
+			rules:   strict,
+			payload: fmt.Sprintf(`{"iss":"traefik-cert","exp":%d}`, at(time.Hour)),
+			reason:  "wrong_audience",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.rules.check([]byte(tt.payload), now)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("check() refused the token: %s (%s)", err, err.Reason)
+				}
+				if claims == nil {
+					t.Fatal("check() returned no claims")
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("check() accepted the token, want %s", tt.reason)
+			}
+			if err.Reason != tt.reason {
+				t.Errorf("check() reason = %s, want %s", err.Reason, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+const (
+	// eventHistory is how many events are kept for clients resuming with
+	// Last-Event-ID.
+	eventHistory = 1024
+	// expiryCheckInterval is how often certificates are checked for
+	// approaching expiry between reloads.
+	expiryCheckInterval = time.Hour
+	// eventKeepAlive is how often an idle event stream gets a comment, so
+	// proxies don't close it.
+	eventKeepAlive = 30 * time.Second
+)
+
+// eventBus turns reloads of the store into certificate lifecycle events and
+// keeps the most recent ones for streaming.
+type eventBus struct {
+	store         *certStore
+	expiryWarning time.Duration
+	logger        *logger.Logger
+	done          chan struct{}
+
+	mu      sync.Mutex
+	events  []types.Event
+	nextID  uint64
+	warned  map[string]bool
+	changed chan struct{}
+}
+
+func newEventBus(store *certStore, expiryWarning time.Duration, logger *logger.Logger) *eventBus {
+	b := &eventBus{
+		store:         store,
+		expiryWarning: expiryWarning,
+		logger:        logger,
+		done:          make(chan struct{}),
+		// Seed IDs from the clock so they keep increasing across restarts,
+		// while staying small enough for JavaScript numbers
+		nextID:  uint64(time.Now().UnixMilli()),
+		warned:  make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+	store.OnChange(b.snapshotChanged)
+	go b.checkExpiryLoop()
+	return b
+}
+
+// certKey identifies "the same certificate" across reloads, so a new entry
+// under an old key is a renewal.
+func certKey(e *certEntry) string {
+	return e.Resolver + "/" + normalizeDomain(e.Main)
+}
+
+// byKey picks the entry served for each key in a snapshot.
+func byKey(snap *certSnapshot) map[string]*certEntry {
+	now := time.Now()
+	entries := make(map[string]*certEntry)
+	for _, e := range snap.entries {
+		key := certKey(e)
+		if cur, ok := entries[key]; !ok || preferable(e, cur, now) {
+			entries[key] = e
+		}
+	}
+	return entries
+}
+
+func (b *eventBus) snapshotChanged(old *certSnapshot, new *certSnapshot) {
+	before := byKey(old)
+	after := byKey(new)
+	var events []types.Event
+	for key, e := range after {
+		prev, ok := before[key]
+		switch {
+		case !ok:
+			events = append(events, newEvent(types.EventAdded, e))
+		case prev.Fingerprint != e.Fingerprint:
+			events = append(events, newEvent(types.EventRenewed, e))
+		}
+	}
+	for key, e := range before {
+		if _, ok := after[key]; !ok {
+			removed := newEvent(types.EventRemoved, e)
+			removed.Fingerprint = ""
+			events = append(events, removed)
+		}
+	}
+	b.publish(events...)
+	b.checkExpiry()
+}
+
+func (b *eventBus) checkExpiryLoop() {
+	b.checkExpiry()
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.checkExpiry()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// checkExpiry publishes an expiring event, once per certificate, for each
+// served certificate within the warning window of its expiry.
+func (b *eventBus) checkExpiry() {
+	if b.expiryWarning <= 0 {
+		return
+	}
+	var events []types.Event
+	b.mu.Lock()
+	for _, e := range byKey(b.store.current()) {
+		if e.Leaf == nil || b.warned[e.Fingerprint] {
+			continue
+		}
+		if time.Until(e.NotAfter()) < b.expiryWarning {
+			b.warned[e.Fingerprint] = true
+			events = append(events, newEvent(types.EventExpiring, e))
+		}
+	}
+	b.mu.Unlock()
+	b.publish(events...)
+}
+
+func newEvent(kind string, e *certEntry) types.Event {
+	event := types.Event{
+		Type:        kind,
+		Time:        time.Now(),
+		Domain:      e.Main,
+		SANs:        e.SANs,
+		Resolver:    e.Resolver,
+		Source:      e.Source,
+		Fingerprint: e.Fingerprint,
+	}
+	if e.Leaf != nil {
+		event.Serial = strings.ToUpper(e.Leaf.SerialNumber.Text(16))
+		event.NotAfter = e.Leaf.NotAfter
+	}
+	return event
+}
+
+func (b *eventBus) publish(events ...types.Event) {
+	if len(events) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, event := range events {
+		b.nextID++
+		event.ID = b.nextID
+		b.events = append(b.events, event)
+		b.logger.Printf("Certificate %s: %s %s from %s", event.Type, event.Resolver, event.Domain, event.Source)
+	}
+	if len(b.events) > eventHistory {
+		b.events = append([]types.Event{}, b.events[len(b.events)-eventHistory:]...)
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Since returns the events after id, along with a channel that's closed
+// when more are published.
+func (b *eventBus) Since(id uint64) ([]types.Event, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []types.Event
+	for _, event := range b.events {
+		if event.ID > id {
+			events = append(events, event)
+		}
+	}
+	return events, b.changed
+}
+
+// LastID returns the ID of the most recent event.
+func (b *eventBus) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nextID
+}
+
+func (b *eventBus) Close() error {
+	close(b.done)
+	return nil
+}
+
+// streamEvents sends certificate events as Server-Sent Events, limited to
+// the domains the client may fetch or inspect. A client reconnecting with
+// Last-Event-ID receives the events it missed, as far as they're kept.
+func streamEvents(auth *authenticator, bus *eventBus, shutdown <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := requireIdentity(auth, w, r)
+		if !ok {
+			return
+		}
+
+		last := bus.LastID()
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+		if lastEventID != "" {
+			var err error
+			last, err = strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		rc := http.NewResponseController(w)
+		// Streams outlive the server's write timeout
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		expired := auth.expiry(id)
+		for {
+			// End the stream once the token is revoked or expires, at the
+			// latest by the next keep-alive
+			err := auth.recheck(id)
+			if err != nil {
+				auth.failed(err.(*authError).Reason)
+				annotate(r).Error = err.Error()
+				return
+			}
+			events, changed := bus.Since(last)
+			for _, event := range events {
+				last = event.ID
+				if !eventVisible(auth, event, id) {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			}
+			if len(events) > 0 {
+				if rc.Flush() != nil {
+					return
+				}
+			}
+
+			select {
+			case <-changed:
+			case <-expired:
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				if rc.Flush() != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			}
+		}
+	})
+}
+
+// eventVisible reports whether the client may know about the event's
+// certificate: whether any name it was granted would be served from it,
+// either because the grant covers one of the certificate's names or because
+// the certificate is a wildcard covering the grant.
+func eventVisible(auth *authenticator, event types.Event, id *identity) bool {
+	names := append([]string{event.Domain}, event.SANs...)
+	for _, grant := range append(append([]string{}, id.Domains...), id.InfoDomains...) {
+		for _, name := range names {
+			if matchDomain(grant, name) && auth.visible(id, name) {
+				return true
+			}
+			if matchDomain(name, grant) && auth.visible(id, grant) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestStreamEventsVisibility(t *testing.T) {
+	auth := &authenticator{
+		jwt:  true,
+		keys: &keyring{keys: []verificationKey{{Key: []byte("secret")}}},
+	}
+	bus := &eventBus{
+		logger:  logger.New(),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	srv := httptest.NewServer(streamEvents(auth, bus, shutdown))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		grants string
+		want   []string
+	}{
+		{
+			name:   "single name served from a wildcard",
+			grants: `"domains": ["mail.example.com"]`,
+			want:   []string{"*.example.com", "mail.example.com"},
+		},
+		{
+			name:   "wildcard grant",
+			grants: `"domains": ["*.example.com"]`,
+			want:   []string{"*.example.com", "mail.example.com", "www.example.com"},
+		},
+		{
+			name:   "info grant",
+			grants: `"domains": [], "info": ["www.example.com"]`,
+			want:   []string{"*.example.com", "www.example.com"},
+		},
+		{
+			name:   "apex only",
+			grants: `"domains": ["example.com"]`,
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := fmt.Sprintf(`{"sub": "dashboard", "exp": %d, "cert": {%s}}`, time.Now().Add(time.Hour).Unix(), tt.grants)
+			req, err := http.NewRequest("GET", srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+sign(t, jose.HS256, []byte("secret"), claims))
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %s", resp.Status)
+			}
+
+			// The stream has started, so it receives everything published
+			// from here on. The last event is visible to every client and
+			// marks the end.
+			bus.publish(
+				types.Event{Type: types.EventRenewed, Domain: "*.example.com"},
+				types.Event{Type: types.EventRenewed, Domain: "mail.example.com"},
+				types.Event{Type: types.EventExpiring, Domain: "www.example.com"},
+				types.Event{Type: types.EventRenewed, Domain: "*.example.org"},
+				types.Event{Type: types.EventRenewed, Domain: "a.mail.example.com"},
+			)
+			bus.publish(types.Event{Type: types.EventRemoved, Domain: "end", SANs: []string{
+				"example.com", "mail.example.com", "www.example.com",
+			}})
+
+			var got []string
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+				var event types.Event
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Fatal(err)
+				}
+				if event.Domain == "end" {
+					break
+				}
+				got = append(got, event.Domain)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("received events for %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
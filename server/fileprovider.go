@@ -0,0 +1,186 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brimstone/logger"
+	"go.yaml.in/yaml/v3"
+)
+
+// fileProviderConfig is the part of a Traefik file provider configuration
+// that lists certificates.
+type fileProviderConfig struct {
+	TLS struct {
+		Certificates []fileProviderCertificate `yaml:"certificates"`
+	} `yaml:"tls"`
+}
+
+// fileProviderCertificate holds either paths to PEM files or the PEM
+// content itself, as Traefik accepts both.
+type fileProviderCertificate struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// fileProviderSource serves the certificates listed under tls.certificates
+// in Traefik file provider configuration.
+type fileProviderSource struct {
+	path string
+}
+
+// NewFileProviderSource returns a source reading the tls.certificates of a
+// Traefik file provider YAML file, or of every .yml and .yaml file in a
+// directory. Certificate and key paths are read as Traefik would, so
+// relative ones are relative to the working directory.
+func NewFileProviderSource(path string) CertificateSource {
+	return &fileProviderSource{path: path}
+}
+
+func (f *fileProviderSource) Name() string {
+	return f.path
+}
+
+func (f *fileProviderSource) Load() ([]Certificate, error) {
+	listed, err := f.certificates()
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]Certificate, 0, len(listed))
+	for _, c := range listed {
+		cert, err := readPEMOrFile(c.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readPEMOrFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var name string
+		if !isPEM(c.CertFile) {
+			name = strings.TrimSuffix(filepath.Base(c.CertFile), filepath.Ext(c.CertFile))
+		}
+		certs = append(certs, certificateFromPEM(cert, key, name))
+	}
+	return certs, nil
+}
+
+// certificates returns the certificates listed in every configuration
+// file.
+func (f *fileProviderSource) certificates() ([]fileProviderCertificate, error) {
+	files, err := f.files()
+	if err != nil {
+		return nil, err
+	}
+	var certs []fileProviderCertificate
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var config fileProviderConfig
+		err = yaml.Unmarshal(raw, &config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		certs = append(certs, config.TLS.Certificates...)
+	}
+	return certs, nil
+}
+
+// files returns the configuration files, the path itself unless it's a
+// directory.
+func (f *fileProviderSource) files() ([]string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{f.path}, nil
+	}
+	entries, err := os.ReadDir(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yml", ".yaml":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(f.path, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// Watch watches the configuration as well as the directories of the
+// certificate and key files it names, so renewed files are picked up too.
+func (f *fileProviderSource) Watch(logger *logger.Logger, onChange func()) (io.Closer, error) {
+	watcher, err := watchDirs(f.dirs, func(string) bool {
+		return true
+	}, logger, onChange)
+	if err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+func (f *fileProviderSource) dirs() []string {
+	dirs := []string{f.path}
+	if info, err := os.Stat(f.path); err != nil || !info.IsDir() {
+		dirs[0] = filepath.Dir(f.path)
+	}
+	seen := map[string]bool{dirs[0]: true}
+	// A configuration that doesn't parse names no further directories
+	certs, _ := f.certificates()
+	for _, c := range certs {
+		for _, file := range []string{c.CertFile, c.KeyFile} {
+			if file == "" || isPEM(file) {
+				continue
+			}
+			dir := filepath.Dir(file)
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// isPEM reports whether a certFile or keyFile value is PEM content rather
+// than a path.
+func isPEM(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN")
+}
+
+// readPEMOrFile returns PEM content given inline, or reads it from the file
+// named.
+func readPEMOrFile(value string) ([]byte, error) {
+	if isPEM(value) {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
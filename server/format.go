@@ -0,0 +1,162 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/brimstone/traefik-cert/types"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// mediaTypes maps each response format to its Content-Type.
+var mediaTypes = map[string]string{
+	types.FormatJSON:   "application/json",
+	types.FormatPEM:    "application/x-pem-file",
+	types.FormatDER:    "application/pkix-cert",
+	types.FormatPKCS12: "application/x-pkcs12",
+}
+
+var (
+	errUnsupportedFormat = errors.New("unsupported format")
+	errMissingPassword   = errors.New("PKCS#12 requires a password in the " + types.PKCS12PasswordHeader + " header")
+)
+
+// negotiateFormat picks the response format from the format query parameter,
+// or failing that the most preferred supported type in the Accept header.
+// JSON is the default.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		format = strings.ToLower(format)
+		if _, ok := mediaTypes[format]; !ok {
+			return "", errUnsupportedFormat
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return types.FormatJSON, nil
+	}
+	best := ""
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		format := ""
+		switch mediatype {
+		case "*/*", "application/*":
+			format = types.FormatJSON
+		default:
+			for f, t := range mediaTypes {
+				if t == mediatype {
+					format = f
+				}
+			}
+		}
+		if format != "" && q > bestQ {
+			best = format
+			bestQ = q
+		}
+	}
+	if best == "" {
+		return "", errUnsupportedFormat
+	}
+	return best, nil
+}
+
+// encodeCert renders a certificate in the requested format.
+func encodeCert(entry *certEntry, format string, r *http.Request) ([]byte, error) {
+	switch format {
+	case types.FormatPEM:
+		bundle := append([]byte{}, entry.Cert...)
+		if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+		return append(bundle, entry.Key...), nil
+	case types.FormatDER:
+		if entry.Leaf == nil {
+			return nil, errors.New("unable to parse certificate")
+		}
+		return entry.Leaf.Raw, nil
+	case types.FormatPKCS12:
+		password := r.Header.Get(types.PKCS12PasswordHeader)
+		if password == "" {
+			return nil, errMissingPassword
+		}
+		keypair, err := entry.TLSCertificate()
+		if err != nil {
+			return nil, err
+		}
+		var chain []*x509.Certificate
+		for _, der := range keypair.Certificate {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, c)
+		}
+		return pkcs12.Modern.Encode(keypair.PrivateKey, chain[0], chain[1:], password)
+	default:
+		return json.Marshal(types.CertResponse{
+			Cert: entry.Cert,
+			Key:  entry.Key,
+		})
+	}
+}
+
+// entityTag is the strong ETag of a certificate in a format. JSON uses the
+// bare fingerprint so clients can compute it from their saved files.
+func entityTag(entry *certEntry, format string) string {
+	if format == types.FormatJSON {
+		return `"` + entry.Fingerprint + `"`
+	}
+	return `"` + entry.Fingerprint + "-" + format + `"`
+}
+
+// noneMatch reports whether the request's If-None-Match header allows the
+// representation with etag to be sent, that is, none of its tags match.
+func noneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brimstone/traefik-cert/types"
+)
+
+// certInfo describes the leaf of an entry. Nothing derived from the private
+// key is included.
+func certInfo(entry *certEntry) (types.CertInfo, error) {
+	leaf := entry.Leaf
+	if leaf == nil {
+		return types.CertInfo{}, errors.New("unable to parse certificate")
+	}
+	fingerprint := sha256.Sum256(leaf.Raw)
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	info := types.CertInfo{
+		Domain:          entry.Main,
+		SANs:            leaf.DNSNames,
+		Resolver:        entry.Resolver,
+		Source:          entry.Source,
+		Subject:         leaf.Subject.String(),
+		Issuer:          leaf.Issuer.String(),
+		Serial:          strings.ToUpper(leaf.SerialNumber.Text(16)),
+		NotBefore:       leaf.NotBefore,
+		NotAfter:        leaf.NotAfter,
+		KeyType:         leaf.PublicKeyAlgorithm.String(),
+		Fingerprint:     hex.EncodeToString(fingerprint[:]),
+		SPKIFingerprint: hex.EncodeToString(spki[:]),
+	}
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeySize = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		info.KeySize = key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		info.KeySize = 256
+	}
+	return info, nil
+}
+
+// setInfoHeaders summarizes the certificate in response headers, so a HEAD
+// request can check it without a body.
+func setInfoHeaders(w http.ResponseWriter, info types.CertInfo) {
+	w.Header().Set("X-Cert-Serial", info.Serial)
+	w.Header().Set("X-Cert-Not-Before", info.NotBefore.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Cert-Not-After", info.NotAfter.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Cert-Fingerprint", info.Fingerprint)
+	if info.Source != "" {
+		w.Header().Set("X-Cert-Source", info.Source)
+	}
+}
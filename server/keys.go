@@ -0,0 +1,497 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// verificationKey is a key tokens may be signed with. A key without an ID
+// is tried for every token.
+type verificationKey struct {
+	ID  string
+	Key interface{}
+	// Algorithm, when set, is the only algorithm the key may verify.
+	Algorithm string
+	// Source is where the key was loaded from, for the logs.
+	Source string
+}
+
+// keyring holds every key tokens are verified against. Local keys are
+// reloaded whenever their files change, and a remote JWKS is refetched
+// when it goes stale or a token names a key it doesn't have, so a new key
+// can be published before tokens signed with it are handed out, and the
+// old one removed once they have expired.
+type keyring struct {
+	sources  []string
+	logger   *logger.Logger
+	watchers []*fileWatcher
+	remote   *remoteJWKS
+
+	mu   sync.RWMutex
+	keys []verificationKey
+}
+
+// HMACSecretPrefix marks a key given as a base64 HMAC secret rather than
+// a path, so a mistyped path is never taken for a secret.
+const HMACSecretPrefix = "base64:"
+
+// newKeyring loads sources, each a PEM public key, a JWKS file, a directory
+// of either, or a base64 HMAC secret after HMACSecretPrefix. jwksURL adds a
+// remote JWKS that is refetched every refresh.
+func newKeyring(sources []string, jwksURL string, refresh time.Duration, logger *logger.Logger) (*keyring, error) {
+	kr := &keyring{
+		sources: sources,
+		logger:  logger,
+	}
+	keys, err := loadKeys(sources, logger)
+	if err != nil {
+		return nil, err
+	}
+	kr.keys = keys
+	if jwksURL != "" {
+		kr.remote = newRemoteJWKS(jwksURL, refresh, logger)
+	} else if len(keys) == 0 {
+		return nil, errors.New("no keys to verify tokens with")
+	}
+
+	for _, source := range sources {
+		if strings.HasPrefix(source, HMACSecretPrefix) {
+			continue
+		}
+		info, err := os.Stat(source)
+		if err != nil {
+			kr.Close()
+			return nil, fmt.Errorf("unable to watch %s: %s", source, err)
+		}
+		var watcher *fileWatcher
+		if info.IsDir() {
+			watcher, err = watchDir(source, logger, kr.reload)
+		} else {
+			watcher, err = watchFile(source, logger, kr.reload)
+		}
+		if err != nil {
+			kr.Close()
+			return nil, fmt.Errorf("unable to watch %s: %s", source, err)
+		}
+		kr.watchers = append(kr.watchers, watcher)
+	}
+	return kr, nil
+}
+
+func (kr *keyring) reload() {
+	keys, err := loadKeys(kr.sources, kr.logger)
+	if err != nil {
+		kr.logger.Printf("Unable to load keys, keeping previous ones: %s", err)
+		return
+	}
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.mu.Unlock()
+	kr.logger.Printf("Loaded %d verification keys", len(keys))
+}
+
+// candidates returns the keys to try for a token naming kid.
+func (kr *keyring) candidates(kid string) []verificationKey {
+	kr.mu.RLock()
+	keys := append([]verificationKey(nil), kr.keys...)
+	kr.mu.RUnlock()
+	if kr.remote != nil {
+		keys = append(keys, kr.remote.keys(kid)...)
+	}
+
+	var matched []verificationKey
+	for _, key := range keys {
+		if kid == "" || key.ID == "" || key.ID == kid {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// verify checks token's signature against the key it names, or every key
+// when it names none, and returns its payload. Only algorithms are accepted,
+// and only with keys of the matching type. The claims are left to
+// TokenRules.
+func (kr *keyring) verify(token string, algorithms []string) ([]byte, error) {
+	obj, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("parsing token: %s", err)
+	}
+	if len(obj.Signatures) != 1 {
+		return nil, errors.New("expected a single signature")
+	}
+	header := obj.Signatures[0].Header
+	if len(algorithms) == 0 {
+		algorithms = DefaultAlgorithms
+	}
+	if header.Algorithm == "" || strings.EqualFold(header.Algorithm, "none") {
+		return nil, refuse("algorithm_refused", "unsigned tokens are refused")
+	}
+	if !contains(algorithms, header.Algorithm) {
+		return nil, refuse("algorithm_refused", "algorithm %s is not accepted", header.Algorithm)
+	}
+
+	var candidates []verificationKey
+	for _, key := range kr.candidates(header.KeyID) {
+		if keyAccepts(key, header.Algorithm) {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no %s key with ID %q", header.Algorithm, header.KeyID)
+	}
+	var payload []byte
+	for _, key := range candidates {
+		payload, err = obj.Verify(key.Key)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to verify token: %s", err)
+}
+
+// DefaultAlgorithms are the signature algorithms accepted when none are
+// configured. An HMAC algorithm still needs an HMAC secret among the keys.
+var DefaultAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+	"HS256", "HS384", "HS512",
+}
+
+// validAlgorithms checks a configured algorithm list.
+func validAlgorithms(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		if !contains(DefaultAlgorithms, algorithm) {
+			return fmt.Errorf("unsupported token algorithm %q", algorithm)
+		}
+	}
+	return nil
+}
+
+// keyAccepts reports whether key may verify a signature by algorithm. Tying
+// the algorithm to the key type is what stops a token signed with HMAC,
+// using a public key as the secret, from verifying.
+func keyAccepts(key verificationKey, algorithm string) bool {
+	if key.Algorithm != "" && key.Algorithm != algorithm {
+		return false
+	}
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(algorithm, "RS") || strings.HasPrefix(algorithm, "PS")
+	case *ecdsa.PublicKey:
+		switch algorithm {
+		case "ES256":
+			return k.Curve == elliptic.P256()
+		case "ES384":
+			return k.Curve == elliptic.P384()
+		case "ES512":
+			return k.Curve == elliptic.P521()
+		}
+	case ed25519.PublicKey:
+		return algorithm == "EdDSA"
+	case []byte:
+		return strings.HasPrefix(algorithm, "HS")
+	}
+	return false
+}
+
+// VerifyToken checks token against the keys in sources and rules, as serve
+// would, and returns its claims.
+func VerifyToken(sources []string, rules TokenRules, token string) (*types.Auth, error) {
+	keys, err := loadKeys(sources, logger.New())
+	if err != nil {
+		return nil, err
+	}
+	kr := &keyring{keys: keys}
+	payload, err := kr.verify(strings.TrimSpace(token), rules.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	claims, tokenErr := rules.check(payload, time.Now())
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	return claims, nil
+}
+
+func (kr *keyring) Close() error {
+	for _, watcher := range kr.watchers {
+		watcher.Close()
+	}
+	return nil
+}
+
+// loadKeys reads every source. A file that can't be parsed fails the whole
+// load, except inside a directory, where it is skipped so a stray file
+// doesn't lock every client out.
+func loadKeys(sources []string, logger *logger.Logger) ([]verificationKey, error) {
+	var keys []verificationKey
+	for _, source := range sources {
+		if encoded, ok := strings.CutPrefix(source, HMACSecretPrefix); ok {
+			secret, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(secret) == 0 {
+				return nil, errors.New("unable to decode HMAC secret")
+			}
+			keys = append(keys, verificationKey{Key: secret, Source: "secret"})
+			continue
+		}
+		info, err := os.Stat(source)
+		if os.IsNotExist(err) && bareSecret(source) {
+			return nil, fmt.Errorf("unable to load key: no such file, and HMAC secrets need the %s prefix", HMACSecretPrefix)
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to load key %s: %s", source, err)
+		}
+		if !info.IsDir() {
+			fileKeys, err := loadKeyFile(source, "")
+			if err != nil {
+				return nil, fmt.Errorf("unable to load key %s: %s", source, err)
+			}
+			keys = append(keys, fileKeys...)
+			continue
+		}
+
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key directory %s: %s", source, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(source, entry.Name())
+			// A PEM key is identified by its file name
+			kid := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			fileKeys, err := loadKeyFile(path, kid)
+			if err != nil {
+				logger.Printf("Skipping key %s: %s", path, err)
+				continue
+			}
+			keys = append(keys, fileKeys...)
+		}
+	}
+	return keys, nil
+}
+
+// bareSecret reports whether source looks like a base64 HMAC secret given
+// without HMACSecretPrefix, as older versions accepted.
+func bareSecret(source string) bool {
+	secret, err := base64.StdEncoding.DecodeString(source)
+	return err == nil && len(secret) > 0
+}
+
+// loadKeyFile reads a JWKS or the PEM public keys in path. PEM keys get the
+// ID kid.
+func loadKeyFile(path string, kid string) ([]verificationKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJWKS(raw, path)
+	}
+
+	var keys []verificationKey
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, verificationKey{ID: kid, Key: key, Source: path})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM public keys found")
+	}
+	return keys, nil
+}
+
+// parseJWKS returns the keys of a JWKS. Private keys are reduced to their
+// public half.
+func parseJWKS(raw []byte, source string) ([]verificationKey, error) {
+	var set jose.JSONWebKeySet
+	err := json.Unmarshal(raw, &set)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JWKS: %s", err)
+	}
+	var keys []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if !jwk.IsPublic() {
+			if public := jwk.Public(); public.Key != nil {
+				jwk = public
+			}
+		}
+		keys = append(keys, verificationKey{
+			ID:        jwk.KeyID,
+			Key:       jwk.Key,
+			Algorithm: jwk.Algorithm,
+			Source:    source,
+		})
+	}
+	return keys, nil
+}
+
+// minRemoteRefresh limits how often a token naming an unknown key can make
+// the server refetch a remote JWKS.
+const minRemoteRefresh = 30 * time.Second
+
+// remoteJWKS caches the keys published at a URL.
+type remoteJWKS struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	logger  *logger.Logger
+
+	mu       sync.Mutex
+	cached   []verificationKey
+	fetched  time.Time
+	tried    time.Time
+	fetching bool
+}
+
+func newRemoteJWKS(url string, refresh time.Duration, logger *logger.Logger) *remoteJWKS {
+	if refresh <= 0 {
+		refresh = 15 * time.Minute
+	}
+	r := &remoteJWKS{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+	}
+	r.tried = time.Now()
+	r.update()
+	return r
+}
+
+// keys returns the cached keys, refetching them first when they are stale
+// or don't include kid. A failed fetch keeps the previous keys. Only one
+// caller fetches at a time, and the others are given the cached keys
+// meanwhile rather than waiting on a slow JWKS host.
+func (r *remoteJWKS) keys(kid string) []verificationKey {
+	r.mu.Lock()
+	now := time.Now()
+	stale := now.Sub(r.fetched) > r.refresh
+	refetch := (stale || !hasKey(r.cached, kid)) && now.Sub(r.tried) > minRemoteRefresh && !r.fetching
+	if refetch {
+		r.tried = now
+		r.fetching = true
+	}
+	r.mu.Unlock()
+
+	if refetch {
+		r.update()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cached
+}
+
+// update fetches the JWKS without holding r.mu.
+func (r *remoteJWKS) update() {
+	keys, err := r.fetch()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetching = false
+	if err != nil {
+		r.logger.Printf("Unable to fetch JWKS from %s, keeping %d cached keys: %s", r.url, len(r.cached), err)
+		return
+	}
+	r.cached = keys
+	r.fetched = time.Now()
+	r.logger.Printf("Fetched %d keys from %s", len(keys), r.url)
+}
+
+func (r *remoteJWKS) fetch() ([]verificationKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(raw, r.url)
+}
+
+func hasKey(keys []verificationKey, kid string) bool {
+	if kid == "" {
+		return len(keys) > 0
+	}
+	for _, key := range keys {
+		if key.ID == kid {
+			return true
+		}
+	}
+	return false
+}
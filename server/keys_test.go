@@ -0,0 +1,247 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brimstone/logger"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestKeyAccepts(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       verificationKey
+		algorithm string
+		want      bool
+	}{
+		{"rsa RS256", verificationKey{Key: &rsaKey.PublicKey}, "RS256", true},
+		{"rsa PS512", verificationKey{Key: &rsaKey.PublicKey}, "PS512", true},
+		{"rsa HS256", verificationKey{Key: &rsaKey.PublicKey}, "HS256", false},
+		{"rsa ES256", verificationKey{Key: &rsaKey.PublicKey}, "ES256", false},
+		{"rsa none", verificationKey{Key: &rsaKey.PublicKey}, "none", false},
+		{"p256 ES256", verificationKey{Key: &p256.PublicKey}, "ES256", true},
+		{"p256 ES384", verificationKey{Key: &p256.PublicKey}, "ES384", false},
+		{"p384 ES384", verificationKey{Key: &p384.PublicKey}, "ES384", true},
+		{"p384 HS384", verificationKey{Key: &p384.PublicKey}, "HS384", false},
+		{"ed25519 EdDSA", verificationKey{Key: edKey}, "EdDSA", true},
+		{"ed25519 HS256", verificationKey{Key: edKey}, "HS256", false},
+		{"secret HS256", verificationKey{Key: []byte("secret")}, "HS256", true},
+		{"secret HS512", verificationKey{Key: []byte("secret")}, "HS512", true},
+		{"secret RS256", verificationKey{Key: []byte("secret")}, "RS256", false},
+		{"restricted match", verificationKey{Key: &rsaKey.PublicKey, Algorithm: "RS256"}, "RS256", true},
+		{"restricted mismatch", verificationKey{Key: &rsaKey.PublicKey, Algorithm: "RS256"}, "PS256", false},
+		{"unknown key type", verificationKey{Key: "secret"}, "HS256", false},
+	}
+	for _, tt := range tests {
+		if got := keyAccepts(tt.key, tt.algorithm); got != tt.want {
+			t.Errorf("%s: keyAccepts(%s) = %v, want %v", tt.name, tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+func sign(t *testing.T, algorithm jose.SignatureAlgorithm, key interface{}, payload string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := signer.Sign([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestKeyringVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	payload := `{"sub":"web"}`
+	kr := &keyring{keys: []verificationKey{{Key: &rsaKey.PublicKey}}}
+
+	t.Run("signed", func(t *testing.T) {
+		got, err := kr.verify(sign(t, jose.RS256, rsaKey, payload), nil)
+		if err != nil {
+			t.Fatalf("verify() = %s", err)
+		}
+		if string(got) != payload {
+			t.Errorf("verify() payload = %s, want %s", got, payload)
+		}
+	})
+
+	t.Run("algorithm not configured", func(t *testing.T) {
+		_, err := kr.verify(sign(t, jose.PS256, rsaKey, payload), []string{"RS256"})
+		var tokenErr *tokenError
+		if !errors.As(err, &tokenErr) || tokenErr.Reason != "algorithm_refused" {
+			t.Errorf("verify() = %v, want algorithm_refused", err)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		encode := base64.RawURLEncoding.EncodeToString
+		token := encode([]byte(`{"alg":"none"}`)) + "." + encode([]byte(payload)) + "."
+		_, err := kr.verify(token, nil)
+		var tokenErr *tokenError
+		if !errors.As(err, &tokenErr) || tokenErr.Reason != "algorithm_refused" {
+			t.Errorf("verify() = %v, want algorithm_refused", err)
+		}
+	})
+
+	t.Run("HMAC with the public key as secret", func(t *testing.T) {
+		token := sign(t, jose.HS256, publicPEM, payload)
+		if _, err := kr.verify(token, nil); err == nil {
+			t.Error("verify() accepted an HS256 token signed with the public key")
+		}
+		if _, err := kr.verify(token, []string{"HS256"}); err == nil {
+			t.Error("verify() accepted an HS256 token signed with the public key when HS256 is configured")
+		}
+	})
+
+	t.Run("HMAC secret", func(t *testing.T) {
+		secret := &keyring{keys: []verificationKey{{Key: []byte("secret")}}}
+		if _, err := secret.verify(sign(t, jose.HS256, []byte("secret"), payload), nil); err != nil {
+			t.Errorf("verify() = %s", err)
+		}
+		if _, err := secret.verify(sign(t, jose.HS256, []byte("other"), payload), nil); err == nil {
+			t.Error("verify() accepted a token signed with another secret")
+		}
+	})
+}
+
+func TestRemoteJWKSSlowRefetch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &rsaKey.PublicKey, KeyID: "old", Algorithm: "RS256", Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			<-release
+		}
+		w.Write(set)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	r := newRemoteJWKS(srv.URL, time.Hour, logger.New())
+	if len(r.cached) != 1 {
+		t.Fatalf("%d keys cached, want 1", len(r.cached))
+	}
+
+	// A token naming an unknown key refetches, and the fetch hangs.
+	r.tried = time.Time{}
+	go r.keys("unknown")
+	for requests.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Meanwhile other tokens are checked against the cached keys, and
+	// don't start another fetch.
+	got := make(chan []verificationKey)
+	go func() {
+		got <- r.keys("other")
+	}()
+	select {
+	case keys := <-got:
+		if len(keys) != 1 || keys[0].ID != "old" {
+			t.Errorf("keys() = %v, want the cached key", keys)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("keys() waited for the other caller's fetch")
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
+
+func TestLoadKeysSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    string
+	}{
+		{"prefixed secret", "base64:c2VjcmV0", ""},
+		{"bare secret", "c2VjcmV0", "need the base64: prefix"},
+		{"empty prefixed secret", "base64:", "unable to decode HMAC secret"},
+		{"missing file", "keys/public.pem", "unable to load key keys/public.pem"},
+	}
+	for _, tt := range tests {
+		keys, err := loadKeys([]string{tt.source}, logger.New())
+		if tt.err == "" {
+			if err != nil || len(keys) != 1 {
+				t.Errorf("%s: loadKeys() = %v, %v", tt.name, keys, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: loadKeys() error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brimstone/logger"
+)
+
+// requestLog collects what the handlers learn about a request, so the
+// access log can report it once the response is written.
+type requestLog struct {
+	// ClientIP is the client's address, after trusted proxies.
+	ClientIP   string
+	AuthMethod string
+	Subject    string
+	TokenID    string
+	Domain     string
+	// Policy is what the domain policy decided, when it denied or would
+	// have denied the request.
+	Policy string
+	// Error is the detail of a refused request, never the credentials.
+	Error string
+	// RateLimits holds the tokens left in each limiter the request passed
+	// through.
+	RateLimits map[string]float64
+	// Release is set when the response carried a private key.
+	Release *keyRelease
+}
+
+// keyRelease is the certificate whose key was sent to the client.
+type keyRelease struct {
+	Domain      string
+	Resolver    string
+	Source      string
+	Serial      string
+	Fingerprint string
+	Format      string
+}
+
+type requestLogKey struct{}
+
+// annotate returns the request's log entry for handlers to fill in. Outside
+// the logging middleware the entry is simply discarded.
+func annotate(r *http.Request) *requestLog {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		return rl
+	}
+	return &requestLog{}
+}
+
+// setIdentity records who made the request.
+func (rl *requestLog) setIdentity(id *identity) {
+	rl.AuthMethod = id.Method
+	rl.Subject = id.Subject
+	rl.TokenID = id.TokenID
+}
+
+// logging writes a structured access log entry for every request, and an
+// audit record for every key release when audit is set.
+func logging(log *logger.Logger, audit *auditLog, proxies trustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rl := &requestLog{ClientIP: proxies.clientIP(r)}
+			r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+			latency := time.Since(start)
+
+			fields := []logger.FieldPair{
+				log.Field("method", r.Method),
+				log.Field("path", r.URL.Path),
+				log.Field("remote", r.RemoteAddr),
+				log.Field("client_ip", rl.ClientIP),
+				log.Field("user_agent", r.UserAgent()),
+				log.Field("status", recorder.Status()),
+				log.Field("latency_ms", float64(latency.Microseconds())/1000),
+			}
+			if rl.Subject != "" || rl.AuthMethod != "" {
+				fields = append(fields,
+					log.Field("auth", rl.AuthMethod),
+					log.Field("subject", rl.Subject),
+				)
+			}
+			if rl.TokenID != "" {
+				fields = append(fields, log.Field("jti", rl.TokenID))
+			}
+			if rl.Domain != "" {
+				fields = append(fields, log.Field("domain", rl.Domain))
+			}
+			for name, tokens := range rl.RateLimits {
+				fields = append(fields, log.Field("ratelimit_"+name, tokens))
+			}
+			if rl.Policy != "" {
+				fields = append(fields, log.Field("policy", rl.Policy))
+			}
+			if rl.Error != "" {
+				fields = append(fields, log.Field("error", rl.Error))
+			}
+			if rl.Release != nil {
+				fields = append(fields,
+					log.Field("key_release", true),
+					log.Field("cert_domain", rl.Release.Domain),
+					log.Field("resolver", rl.Release.Resolver),
+					log.Field("cert_source", rl.Release.Source),
+					log.Field("serial", rl.Release.Serial),
+					log.Field("format", rl.Release.Format),
+				)
+			}
+			if rl.Error != "" || rl.Policy != "" {
+				log.Warn("request", fields...)
+			} else {
+				log.Info("request", fields...)
+			}
+
+			if rl.Release != nil && audit != nil {
+				err := audit.record(auditRecord{
+					Time:        start.UTC(),
+					Remote:      r.RemoteAddr,
+					ClientIP:    rl.ClientIP,
+					UserAgent:   r.UserAgent(),
+					Status:      recorder.Status(),
+					AuthMethod:  rl.AuthMethod,
+					Subject:     rl.Subject,
+					TokenID:     rl.TokenID,
+					Domain:      rl.Domain,
+					CertDomain:  rl.Release.Domain,
+					Resolver:    rl.Release.Resolver,
+					Source:      rl.Release.Source,
+					Serial:      rl.Release.Serial,
+					Fingerprint: rl.Release.Fingerprint,
+					Format:      rl.Release.Format,
+				})
+				if err != nil {
+					log.Error("Unable to write audit log",
+						log.Field("error", err.Error()),
+					)
+				}
+			}
+		})
+	}
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Remote      string    `json:"remote"`
+	ClientIP    string    `json:"client_ip"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Status      int       `json:"status"`
+	AuthMethod  string    `json:"auth"`
+	Subject     string    `json:"subject"`
+	TokenID     string    `json:"jti,omitempty"`
+	Domain      string    `json:"domain"`
+	CertDomain  string    `json:"cert_domain"`
+	Resolver    string    `json:"resolver"`
+	Source      string    `json:"source"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint_sha256"`
+	Format      string    `json:"format"`
+}
+
+// auditLog appends a JSON line per key release to a file that is only ever
+// opened for appending.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %s", err)
+	}
+	return &auditLog{file: file}, nil
+}
+
+func (a *auditLog) record(rec auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// A single write keeps concurrent records from interleaving
+	_, err = a.file.Write(line)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,139 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWatchTimeout is how long a watch waits for a change when the
+	// client doesn't say.
+	defaultWatchTimeout = time.Minute
+	// maxWatchTimeout caps the timeout a client may ask for.
+	maxWatchTimeout = 5 * time.Minute
+)
+
+// watchCert answers /watch/<domain>?since=<fingerprint> once the domain's
+// certificate differs from the one with that fingerprint, replying like
+// /cert/ does. If nothing changes before the timeout it replies 304 Not
+// Modified and the client should ask again.
+func watchCert(auth *authenticator, store *certStore, limits *rateLimits, shutdown <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := strings.TrimPrefix(r.URL.Path, "/watch/")
+		if domain == "" {
+			http.Error(w, "Expected cert", http.StatusBadRequest)
+			return
+		}
+
+		timeout := defaultWatchTimeout
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			var err error
+			timeout, err = time.ParseDuration(t)
+			if err != nil || timeout <= 0 {
+				http.Error(w, "Invalid timeout", http.StatusBadRequest)
+				return
+			}
+			if timeout > maxWatchTimeout {
+				timeout = maxWatchTimeout
+			}
+		}
+
+		format, err := negotiateFormat(r)
+		if err != nil {
+			http.Error(w, "Unsupported format", http.StatusNotAcceptable)
+			return
+		}
+
+		annotate(r).Domain = domain
+		// A watch releases the key as /cert/ does, so it's limited the same
+		if !limits.allowIP(w, r) {
+			return
+		}
+		id, ok := requireIdentity(auth, w, r)
+		if !ok {
+			return
+		}
+		if !limits.allowIdentity(w, r, id) {
+			return
+		}
+		if !authorized(domain, id.Domains) {
+			unauthorizedDomain(auth, w)
+			return
+		}
+		if !auth.permitted(r, id, domain) {
+			http.Error(w, "Unauthorized domain", http.StatusUnauthorized)
+			return
+		}
+
+		// The server's write timeout is far shorter than a watch
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+		since := r.URL.Query().Get("since")
+		resolver := r.URL.Query().Get("resolver")
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		expired := auth.expiry(id)
+		for {
+			// The token may have been revoked or expired while waiting
+			err := auth.recheck(id)
+			if err != nil {
+				refuseIdentity(auth, w, r, err)
+				return
+			}
+			changed := store.Changed()
+			entry := store.Lookup(domain, resolver)
+			if entry != nil && !sameCert(entry, format, since) {
+				if !auth.servable(r, id, entry) {
+					http.Error(w, "Unauthorized domain", http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Vary", "Accept")
+				writeCert(w, r, entry, format)
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-expired:
+			case <-deadline.C:
+				if entry != nil {
+					w.Header().Set("ETag", entityTag(entry, format))
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				// Let the client ask again once the server is back
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+	})
+}
+
+// sameCert reports whether since identifies entry, either by its
+// fingerprint or by the ETag it's served with in format, quoted or not.
+func sameCert(entry *certEntry, format string, since string) bool {
+	since = strings.Trim(since, `"`)
+	return since == entry.Fingerprint || since == strings.Trim(entityTag(entry, format), `"`)
+}
@@ -0,0 +1,85 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/brimstone/logger"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestWatchCertSince(t *testing.T) {
+	now := time.Now()
+	cert := testCertificate(t, "acme.json", "le", now.Add(-time.Hour), now.Add(24*time.Hour), "mail.example.com")
+	store, err := newCertStore([]CertificateSource{&testSource{name: "acme.json", certs: []Certificate{cert}}}, logger.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	entry := store.Lookup("mail.example.com", "")
+
+	auth := &authenticator{
+		jwt:  true,
+		keys: &keyring{keys: []verificationKey{{Key: []byte("secret")}}},
+	}
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	srv := httptest.NewServer(watchCert(auth, store, nil, shutdown))
+	defer srv.Close()
+	claims := fmt.Sprintf(`{"sub": "web", "exp": %d, "cert": {"domains": ["mail.example.com"]}}`, now.Add(time.Hour).Unix())
+	token := sign(t, jose.HS256, []byte("secret"), claims)
+
+	tests := []struct {
+		name   string
+		format string
+		since  string
+		want   int
+	}{
+		{"fingerprint", "json", entry.Fingerprint, http.StatusNotModified},
+		{"fingerprint with pem", "pem", entry.Fingerprint, http.StatusNotModified},
+		{"pem etag", "pem", entityTag(entry, "pem"), http.StatusNotModified},
+		{"unquoted pem etag", "pem", entry.Fingerprint + "-pem", http.StatusNotModified},
+		{"unquoted der etag", "der", entry.Fingerprint + "-der", http.StatusNotModified},
+		{"etag of another format", "pem", entry.Fingerprint + "-der", http.StatusOK},
+		{"old certificate", "pem", "0123", http.StatusOK},
+		{"no since", "pem", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		query := url.Values{"format": {tt.format}, "since": {tt.since}, "timeout": {"50ms"}}
+		req, err := http.NewRequest("GET", srv.URL+"/watch/mail.example.com?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
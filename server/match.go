@@ -0,0 +1,87 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"strings"
+)
+
+// normalizeDomain lowercases a domain and drops any trailing dot so names
+// from tokens, requests and certificates compare equal.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// validWildcard reports whether pattern is a wildcard this service honors.
+// The asterisk must be the entire leftmost label and must be followed by at
+// least two labels, so *.example.com is valid while *, *.com,
+// mail*.example.com and mail.*.example.com are not.
+func validWildcard(pattern string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	rest := pattern[2:]
+	if strings.Contains(rest, "*") {
+		return false
+	}
+	labels := strings.Split(rest, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDomain reports whether pattern covers domain. Every pattern matches
+// itself. A valid wildcard pattern additionally matches a name with exactly
+// one label in place of the asterisk: *.example.com matches
+// mail.example.com, but neither example.com nor a.b.example.com.
+func matchDomain(pattern string, domain string) bool {
+	pattern = normalizeDomain(pattern)
+	domain = normalizeDomain(domain)
+	if pattern == "" || domain == "" {
+		return false
+	}
+	if pattern == domain {
+		return true
+	}
+	if !validWildcard(pattern) || strings.Contains(domain, "*") {
+		return false
+	}
+	label, rest, found := strings.Cut(domain, ".")
+	if !found || label == "" {
+		return false
+	}
+	return rest == pattern[2:]
+}
+
+// authorized reports whether any of the patterns a client was granted
+// covers the requested domain.
+func authorized(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
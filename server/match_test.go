@@ -0,0 +1,77 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"testing"
+)
+
+func TestValidWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"*.example.com", true},
+		{"*.mail.example.com", true},
+		{"*", false},
+		{"*.", false},
+		{"*.com", false},
+		{"mail*.example.com", false},
+		{"mail.*.example.com", false},
+		{"*.*.example.com", false},
+		{"*.example..com", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := validWildcard(tt.pattern); got != tt.want {
+			t.Errorf("validWildcard(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		pattern string
+		domain  string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"Example.COM.", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"*.example.com", "mail.example.com", true},
+		{"*.example.com", "MAIL.Example.com.", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "*.example.com", true},
+		{"*.example.com", "*.other.example.com", false},
+		{"*.com", "example.com", false},
+		{"*.com", "*.com", true},
+		{"mail*.example.com", "mail1.example.com", false},
+		{"mail.*.example.com", "mail.a.example.com", false},
+		{"", "", false},
+		{"example.com", "", false},
+	}
+	for _, tt := range tests {
+		if got := matchDomain(tt.pattern, tt.domain); got != tt.want {
+			t.Errorf("matchDomain(%q, %q) = %v, want %v", tt.pattern, tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics of one server.
+type metrics struct {
+	registry     *prometheus.Registry
+	requests     *prometheus.CounterVec
+	authFailures *prometheus.CounterVec
+	loadDuration prometheus.Histogram
+	loadErrors   prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "traefik_cert_http_requests_total",
+			Help: "HTTP requests by route and status code.",
+		}, []string{"route", "code"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "traefik_cert_auth_failures_total",
+			Help: "Requests refused by authentication or authorization, by reason.",
+		}, []string{"reason"}),
+		loadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "traefik_cert_acme_load_duration_seconds",
+			Help:    "Time taken to load a certificate source.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		loadErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "traefik_cert_acme_load_errors_total",
+			Help: "Loads of a certificate source that failed and kept its previous certificates.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.authFailures,
+		m.loadDuration,
+		m.loadErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeLoad records one attempt to load a certificate source.
+func (m *metrics) observeLoad(duration time.Duration, err error) {
+	m.loadDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.loadErrors.Inc()
+	}
+}
+
+// authFailed records a refused request.
+func (m *metrics) authFailed(reason string) {
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+// watchStore exports the number of certificates and the expiry of the
+// certificate served for each domain, read from the store at scrape time.
+func (m *metrics) watchStore(store *certStore) {
+	m.registry.MustRegister(&storeCollector{store: store})
+}
+
+var (
+	certificatesDesc = prometheus.NewDesc(
+		"traefik_cert_certificates",
+		"Certificates served from every source.",
+		nil, nil,
+	)
+	lastLoadDesc = prometheus.NewDesc(
+		"traefik_cert_acme_last_load_timestamp_seconds",
+		"Time of the last successful load of a certificate source.",
+		nil, nil,
+	)
+	expiryDesc = prometheus.NewDesc(
+		"cert_expiry_timestamp_seconds",
+		"Expiry of the certificate served for each domain.",
+		[]string{"domain", "resolver"}, nil,
+	)
+)
+
+type storeCollector struct {
+	store *certStore
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificatesDesc
+	ch <- lastLoadDesc
+	ch <- expiryDesc
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	loaded, certificates, _ := c.store.Status()
+	ch <- prometheus.MustNewConstMetric(certificatesDesc, prometheus.GaugeValue, float64(certificates))
+	if !loaded.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastLoadDesc, prometheus.GaugeValue, float64(loaded.Unix()))
+	}
+	for domain, entries := range c.store.current().index {
+		entry := preferred(entries, "")
+		if entry == nil || entry.Leaf == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(expiryDesc, prometheus.GaugeValue,
+			float64(entry.NotAfter().Unix()), domain, entry.Resolver)
+	}
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument counts every request by route and status code.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		m.requests.WithLabelValues(route(r), strconv.Itoa(recorder.Status())).Inc()
+	})
+}
+
+// route names the handler a request went to, keeping label values bounded.
+func route(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/cert/") && strings.HasSuffix(r.URL.Path, "/info"):
+		return "info"
+	case strings.HasPrefix(r.URL.Path, "/cert/"):
+		return "cert"
+	case strings.HasPrefix(r.URL.Path, "/watch/"):
+		return "watch"
+	}
+	switch r.URL.Path {
+	case "/":
+		return "index"
+	case "/events", "/healthz", "/metrics", "/status":
+		return strings.TrimPrefix(r.URL.Path, "/")
+	case "/admin/certs":
+		return "admin"
+	}
+	return "other"
+}
+
+// statusRecorder remembers the status code written through it. Unwrap lets
+// http.ResponseController reach the flusher and deadlines underneath.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Status returns the status code sent, 200 if the handler never set one.
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
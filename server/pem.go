@@ -0,0 +1,164 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brimstone/logger"
+)
+
+// pemCertExtensions are tried in order to find the certificate paired
+// with a key in a PEM directory.
+var pemCertExtensions = []string{".crt", ".pem", ".cert"}
+
+// pemDirSource serves PEM certificate and key pairs from a directory, each
+// pair sharing a file name: example.com.crt and example.com.key.
+type pemDirSource struct {
+	dir string
+}
+
+// NewPEMDirSource returns a source reading every NAME.key in dir along
+// with the certificate chain in NAME.crt, NAME.pem or NAME.cert. The
+// certificate is served for the names it holds.
+func NewPEMDirSource(dir string) CertificateSource {
+	return &pemDirSource{dir: dir}
+}
+
+func (d *pemDirSource) Name() string {
+	return d.dir
+}
+
+func (d *pemDirSource) Load() ([]Certificate, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var certs []Certificate
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".key" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".key")
+		cert, err := d.readCert(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			// A key without a certificate isn't a pair
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(filepath.Join(d.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, certificateFromPEM(cert, key, name))
+	}
+	return certs, nil
+}
+
+// readCert reads the certificate paired with the key NAME.key.
+func (d *pemDirSource) readCert(name string) ([]byte, error) {
+	var err error
+	for _, ext := range pemCertExtensions {
+		var cert []byte
+		cert, err = os.ReadFile(filepath.Join(d.dir, name+ext))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return cert, err
+		}
+	}
+	return nil, err
+}
+
+func (d *pemDirSource) Watch(logger *logger.Logger, onChange func()) (io.Closer, error) {
+	watcher, err := watchDir(d.dir, logger, onChange)
+	if err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// certbotSource serves certificates from certbot's live directory, which
+// holds a directory for each certificate with fullchain.pem and
+// privkey.pem linked to the latest issue.
+type certbotSource struct {
+	dir string
+}
+
+// NewCertbotSource returns a source reading the certificates certbot keeps
+// in dir, usually /etc/letsencrypt/live.
+func NewCertbotSource(dir string) CertificateSource {
+	return &certbotSource{dir: dir}
+}
+
+func (c *certbotSource) Name() string {
+	return c.dir
+}
+
+func (c *certbotSource) Load() ([]Certificate, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var certs []Certificate
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		cert, err := os.ReadFile(filepath.Join(c.dir, entry.Name(), "fullchain.pem"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(filepath.Join(c.dir, entry.Name(), "privkey.pem"))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, certificateFromPEM(cert, key, entry.Name()))
+	}
+	return certs, nil
+}
+
+// Watch watches each certificate's directory as well as the live directory,
+// since renewals only relink the files in the former.
+func (c *certbotSource) Watch(logger *logger.Logger, onChange func()) (io.Closer, error) {
+	watcher, err := watchDirs(c.dirs, func(string) bool {
+		return true
+	}, logger, onChange)
+	if err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+func (c *certbotSource) dirs() []string {
+	dirs := []string{c.dir}
+	entries, _ := os.ReadDir(c.dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(c.dir, entry.Name()))
+		}
+	}
+	return dirs
+}
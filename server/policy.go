@@ -0,0 +1,238 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/brimstone/logger"
+	"go.yaml.in/yaml/v3"
+)
+
+// policyRule limits the domains a client may fetch. A domain must match an
+// allow pattern and no deny pattern.
+type policyRule struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// policyDocument is the YAML policy file.
+type policyDocument struct {
+	// Deny lists domains no client may fetch, whatever it was granted.
+	Deny []string `yaml:"deny"`
+	// Subjects and Issuers hold the rules for tokens with a matching sub or
+	// iss, and client certificates with a matching subject or issuer.
+	Subjects map[string]policyRule `yaml:"subjects"`
+	Issuers  map[string]policyRule `yaml:"issuers"`
+	// Default applies to clients no subject or issuer rule names. Without
+	// it they may fetch nothing.
+	Default *policyRule `yaml:"default"`
+}
+
+// policy caps the domains clients may fetch, on top of what their token or
+// client certificate grants, so a leaked signing key can't hand out every
+// certificate. The file is reloaded whenever it changes, keeping the
+// previous policy if the new one is invalid.
+type policy struct {
+	path    string
+	logger  *logger.Logger
+	watcher *fileWatcher
+	// dryRun logs what would be denied instead of denying it.
+	dryRun bool
+
+	mu  sync.RWMutex
+	doc *policyDocument
+}
+
+func newPolicy(path string, dryRun bool, logger *logger.Logger) (*policy, error) {
+	doc, err := readPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{
+		path:   path,
+		logger: logger,
+		dryRun: dryRun,
+		doc:    doc,
+	}
+	watcher, err := watchFile(path, logger, p.reload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch %s: %s", path, err)
+	}
+	p.watcher = watcher
+	return p, nil
+}
+
+func (p *policy) reload() {
+	doc, err := readPolicy(p.path)
+	if err != nil {
+		p.logger.Printf("Unable to load %s, keeping previous policy: %s", p.path, err)
+		return
+	}
+	p.mu.Lock()
+	p.doc = doc
+	p.mu.Unlock()
+	p.logger.Printf("Loaded policy from %s", p.path)
+}
+
+// check returns why the policy denies id the domain, or an empty string if
+// it allows it. Every rule naming the client's subject or issuer must allow
+// the domain.
+func (p *policy) check(id *identity, domain string) string {
+	p.mu.RLock()
+	doc := p.doc
+	p.mu.RUnlock()
+
+	if authorized(domain, doc.Deny) {
+		return "denied for every client"
+	}
+	var rules []string
+	if rule, ok := doc.Subjects[id.Subject]; ok {
+		if reason := rule.check(domain); reason != "" {
+			return reason + " for subject " + id.Subject
+		}
+		rules = append(rules, "subject")
+	}
+	if rule, ok := doc.Issuers[id.Issuer]; ok && id.Issuer != "" {
+		if reason := rule.check(domain); reason != "" {
+			return reason + " for issuer " + id.Issuer
+		}
+		rules = append(rules, "issuer")
+	}
+	if len(rules) > 0 {
+		return ""
+	}
+	if doc.Default == nil {
+		return "no rule for subject " + id.Subject
+	}
+	if reason := doc.Default.check(domain); reason != "" {
+		return reason + " by default"
+	}
+	return ""
+}
+
+// checkServed returns why the policy denies id a certificate holding
+// names, or an empty string if it doesn't. Only deny patterns apply here,
+// to every name the certificate covers, since its key serves them all: a
+// client allowed www.example.com mustn't get a *.example.com certificate
+// when vault.example.com is denied to it.
+func (p *policy) checkServed(id *identity, names []string) string {
+	p.mu.RLock()
+	doc := p.doc
+	p.mu.RUnlock()
+
+	if name := deniedName(names, doc.Deny); name != "" {
+		return "certificate covers " + name + ", denied for every client"
+	}
+	named := false
+	if rule, ok := doc.Subjects[id.Subject]; ok {
+		named = true
+		if name := deniedName(names, rule.Deny); name != "" {
+			return "certificate covers " + name + ", denied for subject " + id.Subject
+		}
+	}
+	if rule, ok := doc.Issuers[id.Issuer]; ok && id.Issuer != "" {
+		named = true
+		if name := deniedName(names, rule.Deny); name != "" {
+			return "certificate covers " + name + ", denied for issuer " + id.Issuer
+		}
+	}
+	if !named && doc.Default != nil {
+		if name := deniedName(names, doc.Default.Deny); name != "" {
+			return "certificate covers " + name + ", denied by default"
+		}
+	}
+	return ""
+}
+
+// deniedName returns the first of names sharing a name with a deny
+// pattern, either way round, or an empty string.
+func deniedName(names []string, deny []string) string {
+	for _, name := range names {
+		for _, pattern := range deny {
+			if matchDomain(pattern, name) || matchDomain(name, pattern) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (r policyRule) check(domain string) string {
+	if authorized(domain, r.Deny) {
+		return "denied"
+	}
+	if !authorized(domain, r.Allow) {
+		return "not allowed"
+	}
+	return ""
+}
+
+func (p *policy) Close() error {
+	return p.watcher.Close()
+}
+
+func readPolicy(path string) (*policyDocument, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy: %s", err)
+	}
+	var doc policyDocument
+	err = yaml.Unmarshal(raw, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse policy: %s", err)
+	}
+	err = validatePatterns("deny", doc.Deny)
+	if err != nil {
+		return nil, err
+	}
+	rules := map[string]policyRule{}
+	for subject, rule := range doc.Subjects {
+		rules["subject "+subject] = rule
+	}
+	for issuer, rule := range doc.Issuers {
+		rules["issuer "+issuer] = rule
+	}
+	if doc.Default != nil {
+		rules["default"] = *doc.Default
+	}
+	for name, rule := range rules {
+		err = validatePatterns(name+" allow", rule.Allow)
+		if err == nil {
+			err = validatePatterns(name+" deny", rule.Deny)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &doc, nil
+}
+
+// validatePatterns catches wildcards that would silently never match.
+func validatePatterns(name string, patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "*") && !validWildcard(normalizeDomain(pattern)) {
+			return fmt.Errorf("policy %s: invalid wildcard %q", name, pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const testPolicy = `
+deny:
+  - secret.example.com
+subjects:
+  web:
+    allow: ["*.example.com", "example.com"]
+    deny: ["vault.example.com"]
+  shared:
+    allow: ["*.example.com"]
+issuers:
+  partner:
+    allow: ["*.partner.example.com", "*.example.com"]
+    deny: ["admin.example.com"]
+default:
+  allow: ["public.example.com", "*.example.com"]
+  deny: ["internal.example.com"]
+`
+
+func testPolicyFrom(t *testing.T, raw string, dryRun bool) *policy {
+	t.Helper()
+	var doc policyDocument
+	if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return &policy{doc: &doc, dryRun: dryRun}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p := testPolicyFrom(t, testPolicy, false)
+	tests := []struct {
+		subject string
+		issuer  string
+		domain  string
+		denied  bool
+	}{
+		{"web", "", "www.example.com", false},
+		{"web", "", "example.com", false},
+		{"web", "", "vault.example.com", true},
+		{"web", "", "secret.example.com", true},
+		{"web", "", "www.example.org", true},
+		// Subject and issuer rules must both allow the domain
+		{"web", "partner", "www.example.com", false},
+		{"web", "partner", "admin.example.com", true},
+		{"shared", "partner", "api.partner.example.com", true},
+		{"unknown", "partner", "api.partner.example.com", false},
+		// Clients no rule names fall back to the default
+		{"unknown", "", "public.example.com", false},
+		{"unknown", "", "internal.example.com", true},
+		{"unknown", "", "www.example.org", true},
+		{"unknown", "", "secret.example.com", true},
+	}
+	for _, tt := range tests {
+		reason := p.check(&identity{Subject: tt.subject, Issuer: tt.issuer}, tt.domain)
+		if (reason != "") != tt.denied {
+			t.Errorf("check(%s, %s, %s) = %q, want denied %v", tt.subject, tt.issuer, tt.domain, reason, tt.denied)
+		}
+	}
+
+	withoutDefault := testPolicyFrom(t, "subjects:\n  web:\n    allow: [\"*.example.com\"]\n", false)
+	if reason := withoutDefault.check(&identity{Subject: "unknown"}, "www.example.com"); reason == "" {
+		t.Error("check() allowed a client no rule names without a default")
+	}
+}
+
+func TestPolicyCheckServed(t *testing.T) {
+	p := testPolicyFrom(t, testPolicy, false)
+	tests := []struct {
+		subject string
+		issuer  string
+		names   []string
+		denied  string
+	}{
+		{"web", "", []string{"www.example.com"}, ""},
+		{"web", "", []string{"www.example.com", "vault.example.com"}, "vault.example.com"},
+		// A wildcard certificate also serves the names denied to the client
+		{"web", "", []string{"*.example.com"}, "*.example.com"},
+		{"web", "", []string{"example.com", "*.example.com"}, "*.example.com"},
+		{"shared", "", []string{"*.example.com"}, "*.example.com"},
+		{"shared", "", []string{"www.example.com"}, ""},
+		{"shared", "partner", []string{"admin.example.com"}, "admin.example.com"},
+		{"unknown", "", []string{"*.example.com"}, "*.example.com"},
+		{"unknown", "", []string{"public.example.com", "www.example.com"}, ""},
+		{"unknown", "", []string{"internal.example.com"}, "internal.example.com"},
+		// The default doesn't apply to a client an issuer rule names
+		{"unknown", "partner", []string{"internal.example.com"}, ""},
+	}
+	for _, tt := range tests {
+		reason := p.checkServed(&identity{Subject: tt.subject, Issuer: tt.issuer}, tt.names)
+		if tt.denied == "" {
+			if reason != "" {
+				t.Errorf("checkServed(%s, %s, %v) = %q, want allowed", tt.subject, tt.issuer, tt.names, reason)
+			}
+			continue
+		}
+		if !strings.Contains(reason, "covers "+tt.denied+",") {
+			t.Errorf("checkServed(%s, %s, %v) = %q, want %s denied", tt.subject, tt.issuer, tt.names, reason, tt.denied)
+		}
+	}
+}
+
+func TestPolicyDryRun(t *testing.T) {
+	id := &identity{Subject: "web"}
+	entry := &certEntry{Main: "*.example.com"}
+	for _, dryRun := range []bool{false, true} {
+		auth := &authenticator{policy: testPolicyFrom(t, testPolicy, dryRun)}
+		rl := &requestLog{}
+		r := httptest.NewRequest("GET", "/cert/vault.example.com", nil)
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+
+		if got := auth.permitted(r, id, "vault.example.com"); got != dryRun {
+			t.Errorf("dry run %v: permitted() = %v", dryRun, got)
+		}
+		want := "denied: "
+		if dryRun {
+			want = "would deny: "
+		}
+		if !strings.HasPrefix(rl.Policy, want) {
+			t.Errorf("dry run %v: logged %q, want %q", dryRun, rl.Policy, want)
+		}
+
+		rl.Policy = ""
+		if got := auth.servable(r, id, entry); got != dryRun {
+			t.Errorf("dry run %v: servable() = %v", dryRun, got)
+		}
+		if !strings.HasPrefix(rl.Policy, want) {
+			t.Errorf("dry run %v: logged %q, want %q", dryRun, rl.Policy, want)
+		}
+		if got := auth.visible(id, "vault.example.com"); got != dryRun {
+			t.Errorf("dry run %v: visible() = %v", dryRun, got)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter keeps a token bucket per key, refilled at perMinute requests
+// a minute and holding at most burst.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// newRateLimiter returns nil, which allows everything, when perMinute is
+// zero.
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		limit:   rate.Limit(perMinute / 60),
+		burst:   burst,
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// allow takes a token from key's bucket. It returns how long to wait when
+// the bucket is empty, and the tokens left either way.
+func (l *rateLimiter) allow(key string) (time.Duration, float64) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, b.limiter.TokensAt(now)
+	}
+	return 0, b.limiter.TokensAt(now)
+}
+
+// sweep forgets buckets that have been idle long enough to refill, at most
+// once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.seen) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimits are the limits applied to /cert/. Either may be nil.
+type rateLimits struct {
+	ip    *rateLimiter
+	token *rateLimiter
+}
+
+// check takes a token from limiter for key, answering the request with 429
+// when there is none. The limiter state goes to the access log.
+func (rl *rateLimits) check(limiter *rateLimiter, name string, key string, w http.ResponseWriter, r *http.Request) bool {
+	if limiter == nil {
+		return true
+	}
+	delay, tokens := limiter.allow(key)
+	entry := annotate(r)
+	if entry.RateLimits == nil {
+		entry.RateLimits = make(map[string]float64)
+	}
+	entry.RateLimits[name] = math.Floor(tokens*100) / 100
+	if delay == 0 {
+		return true
+	}
+	entry.Error = fmt.Sprintf("rate limited by %s", name)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
+
+// allowIP applies the per address limit to the client address found by the
+// logging middleware.
+func (rl *rateLimits) allowIP(w http.ResponseWriter, r *http.Request) bool {
+	if rl == nil {
+		return true
+	}
+	ip := annotate(r).ClientIP
+	if ip == "" {
+		ip = r.RemoteAddr
+	}
+	return rl.check(rl.ip, "ip", ip, w, r)
+}
+
+// allowIdentity applies the per token limit, keyed by the token's jti when
+// it has one so a reissued token for the same subject starts afresh. A
+// token with neither jti nor sub is keyed by its hash, so such tokens don't
+// share a bucket.
+func (rl *rateLimits) allowIdentity(w http.ResponseWriter, r *http.Request, id *identity) bool {
+	if rl == nil {
+		return true
+	}
+	key := id.Method + ":sub:" + id.Subject
+	if id.TokenID != "" {
+		key = id.Method + ":jti:" + id.TokenID
+	} else if id.Subject == "" && id.TokenHash != "" {
+		key = id.Method + ":hash:" + id.TokenHash
+	}
+	return rl.check(rl.token, "token", key, w, r)
+}
+
+// trustedProxies are the addresses allowed to report the client address in
+// X-Forwarded-For.
+type trustedProxies []netip.Prefix
+
+func parseTrustedProxies(proxies []string) (trustedProxies, error) {
+	var trusted trustedProxies
+	// Proxies from the environment arrive as a single comma separated value
+	for _, proxy := range strings.Split(strings.Join(proxies, ","), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %s", proxy, err)
+			}
+			trusted = append(trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", proxy, err)
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return trusted, nil
+}
+
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed as far back as it was appended by trusted proxies, so a client
+// can't pick its own address by sending the header itself.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !t.contains(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
@@ -0,0 +1,129 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowIdentity(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  identity
+		second identity
+		shared bool
+	}{
+		{
+			name:   "same jti",
+			first:  identity{Method: AuthJWT, Subject: "web", TokenID: "1", TokenHash: "a"},
+			second: identity{Method: AuthJWT, Subject: "web", TokenID: "1", TokenHash: "b"},
+			shared: true,
+		},
+		{
+			name:   "reissued token",
+			first:  identity{Method: AuthJWT, Subject: "web", TokenID: "1", TokenHash: "a"},
+			second: identity{Method: AuthJWT, Subject: "web", TokenID: "2", TokenHash: "b"},
+		},
+		{
+			name:   "same subject without jti",
+			first:  identity{Method: AuthJWT, Subject: "web", TokenHash: "a"},
+			second: identity{Method: AuthJWT, Subject: "web", TokenHash: "b"},
+			shared: true,
+		},
+		{
+			name:   "neither jti nor sub",
+			first:  identity{Method: AuthJWT, TokenHash: "a"},
+			second: identity{Method: AuthJWT, TokenHash: "b"},
+		},
+		{
+			name:   "same token without jti or sub",
+			first:  identity{Method: AuthJWT, TokenHash: "a"},
+			second: identity{Method: AuthJWT, TokenHash: "a"},
+			shared: true,
+		},
+		{
+			name:   "client certificate",
+			first:  identity{Method: AuthMTLS, Subject: "CN=web"},
+			second: identity{Method: AuthMTLS, Subject: "CN=web"},
+			shared: true,
+		},
+	}
+	for _, tt := range tests {
+		rl := &rateLimits{token: newRateLimiter(1, 1)}
+		r := httptest.NewRequest("GET", "/cert/example.com", nil)
+		if !rl.allowIdentity(httptest.NewRecorder(), r, &tt.first) {
+			t.Fatalf("%s: first request refused", tt.name)
+		}
+		w := httptest.NewRecorder()
+		allowed := rl.allowIdentity(w, r, &tt.second)
+		if allowed == tt.shared {
+			t.Errorf("%s: second request allowed = %v, want %v", tt.name, allowed, !tt.shared)
+		}
+		if !allowed && w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, http.StatusTooManyRequests)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8, 192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:4321", nil, "203.0.113.7"},
+		{"spoofed by an untrusted client", "203.0.113.7:4321", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:4321", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without the header", "10.1.2.3:4321", nil, "10.1.2.3"},
+		{"spoofed hop before a trusted proxy", "10.1.2.3:4321", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:4321", []string{"198.51.100.1, 192.168.1.1, 10.9.9.9"}, "198.51.100.1"},
+		{"untrusted hop in the middle", "10.1.2.3:4321", []string{"198.51.100.1, 203.0.113.9, 10.9.9.9"}, "203.0.113.9"},
+		{"repeated headers", "10.1.2.3:4321", []string{"1.1.1.1", "198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"garbage hop", "10.1.2.3:4321", []string{"1.1.1.1, not-an-ip, 10.9.9.9"}, "10.9.9.9"},
+		{"single address proxy", "192.168.1.1:4321", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"neighbour of a single address proxy", "192.168.1.2:4321", []string{"198.51.100.1"}, "192.168.1.2"},
+		{"ipv6 proxy", "[::1]:4321", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"ipv4 mapped proxy", "[::ffff:10.1.2.3]:4321", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/cert/example.com", nil)
+		r.RemoteAddr = tt.remote
+		for _, header := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := proxies.clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	var none trustedProxies
+	r := httptest.NewRequest("GET", "/cert/example.com", nil)
+	r.RemoteAddr = "10.1.2.3:4321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := none.clientIP(r); got != "10.1.2.3" {
+		t.Errorf("clientIP() without trusted proxies = %s, want 10.1.2.3", got)
+	}
+}
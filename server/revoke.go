@@ -0,0 +1,193 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brimstone/logger"
+)
+
+const (
+	// RevokeTokenID revokes the token with this jti.
+	RevokeTokenID = "jti"
+	// RevokeSubject revokes every token issued to this subject.
+	RevokeSubject = "sub"
+	// RevokeTokenHash revokes the token with this types.TokenHash.
+	RevokeTokenHash = "sha256"
+)
+
+// revocations holds the entries of a revocation file, reloading them
+// whenever it changes. Each line is a kind and a value, like `jti:abc123`,
+// and anything after a # is a comment.
+type revocations struct {
+	path    string
+	logger  *logger.Logger
+	watcher *fileWatcher
+
+	mu      sync.RWMutex
+	entries map[string]bool
+}
+
+// newRevocations loads path. A file that doesn't exist yet revokes nothing
+// until it is created.
+func newRevocations(path string, logger *logger.Logger) (*revocations, error) {
+	rv := &revocations{
+		path:    path,
+		logger:  logger,
+		entries: map[string]bool{},
+	}
+	entries, err := readRevocations(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	rv.entries = entries
+	watcher, err := watchFile(path, logger, rv.reload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch %s: %s", path, err)
+	}
+	rv.watcher = watcher
+	return rv, nil
+}
+
+func (rv *revocations) reload() {
+	entries, err := readRevocations(rv.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		rv.logger.Printf("Unable to load %s, keeping previous revocations: %s", rv.path, err)
+		return
+	}
+	rv.mu.Lock()
+	rv.entries = entries
+	rv.mu.Unlock()
+	rv.logger.Printf("Loaded %d revocations from %s", len(entries), rv.path)
+}
+
+// revoked returns the entry revoking id, or an empty string if there is
+// none.
+func (rv *revocations) revoked(id *identity) string {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+	candidates := []string{RevokeSubject + ":" + id.Subject}
+	if id.TokenID != "" {
+		candidates = append(candidates, RevokeTokenID+":"+id.TokenID)
+	}
+	if id.TokenHash != "" {
+		candidates = append(candidates, RevokeTokenHash+":"+id.TokenHash)
+	}
+	for _, candidate := range candidates {
+		if rv.entries[candidate] {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func (rv *revocations) Close() error {
+	return rv.watcher.Close()
+}
+
+func readRevocations(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return map[string]bool{}, err
+	}
+	defer file.Close()
+	// Wait out any append in progress
+	err = lockFile(file, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(file)
+
+	entries := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		kind, value, err := parseRevocation(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		entries[kind+":"+value] = true
+	}
+	return entries, scanner.Err()
+}
+
+func parseRevocation(entry string) (string, string, error) {
+	kind, value, ok := strings.Cut(entry, ":")
+	if !ok || value == "" {
+		return "", "", fmt.Errorf("expected kind:value, got %q", entry)
+	}
+	switch kind {
+	case RevokeTokenID, RevokeSubject, RevokeTokenHash:
+	default:
+		return "", "", fmt.Errorf("unknown revocation kind %q", kind)
+	}
+	if strings.ContainsAny(value, "#\r\n") {
+		return "", "", fmt.Errorf("revoked %s can't contain # or line breaks", kind)
+	}
+	return kind, value, nil
+}
+
+// AppendRevocation adds an entry of kind to the revocation file at path,
+// creating it if needed. The file is locked and written with a single
+// append, so concurrent writers and a reloading server never see half a
+// line.
+func AppendRevocation(path string, kind string, value string, reason string) error {
+	kind, value, err := parseRevocation(kind + ":" + strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(reason, "\r\n") {
+		return errors.New("reason can't contain line breaks")
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = lockFile(file, true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(file)
+
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s:%s # %s", kind, value, time.Now().UTC().Format(time.RFC3339))
+	if reason != "" {
+		fmt.Fprintf(&line, " %s", reason)
+	}
+	line.WriteByte('\n')
+	_, err = file.Write(line.Bytes())
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -20,11 +20,10 @@ package server
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -32,49 +31,276 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/brimstone/jwt/jwt"
+	"github.com/brimstone/logger"
 	"github.com/brimstone/traefik-cert/types"
 )
 
 type Server struct {
-	acmefile string
-	address  string
-	healthy  *int32
-	key      string
-	logger   *log.Logger
-	router   *http.ServeMux
-	server   *http.Server
+	address   string
+	audit     *auditLog
+	auth      *authenticator
+	clientCA  string
+	events    *eventBus
+	healthy   *int32
+	metrics   *metrics
+	keypair   *keypair
+	limits    *rateLimits
+	logger    *logger.Logger
+	proxies   trustedProxies
+	router    *http.ServeMux
+	server    *http.Server
+	shutdown  chan struct{}
+	store     *certStore
+	tlsCert   string
+	tlsDomain string
+	tlsKey    string
+	webhooks  *webhookSender
+
+	// metricsServer serves /metrics on metricsAddress, when it's set.
+	metricsAddress string
+	metricsServer  *http.Server
 }
 
 type ServerOptions struct {
+	Address string
+	// MetricsAddress serves /metrics over plain HTTP on this address
+	// instead of Address, so the domains and expiries it lists can be kept
+	// off the network clients reach.
+	MetricsAddress string
+	// AcmeFile is a Traefik acme.json to serve certificates from. It is
+	// kept for compatibility and served along with AcmeFiles.
 	AcmeFile string
-	Address  string
-	Key      string
+	// AcmeFiles are further acme.json files or glob patterns of them,
+	// expanded once when the server starts. When several hold a
+	// certificate for the same name, the newest valid one is served.
+	AcmeFiles []string
+	// PEMDirs are directories of NAME.key files and their certificates in
+	// NAME.crt, NAME.pem or NAME.cert.
+	PEMDirs []string
+	// CertbotDirs are certbot live directories, such as
+	// /etc/letsencrypt/live.
+	CertbotDirs []string
+	// FileProviders are Traefik file provider YAML files, or directories
+	// of them, whose tls.certificates are served.
+	FileProviders []string
+	// Sources are further certificate sources, served along with the
+	// ones above.
+	Sources []CertificateSource
+	// Key is a single verification key. It is kept for compatibility and
+	// checked along with Keys.
+	Key string
+	// Keys verify bearer tokens. Each is a PEM public key, a JWKS file, a
+	// directory of them, or a base64 HMAC secret after HMACSecretPrefix. A
+	// PEM key in a directory has its file name, without the extension, as
+	// its kid.
+	Keys []string
+	// JWKSURL is fetched for further keys, and refetched every JWKSRefresh
+	// or when a token names a key it hasn't seen.
+	JWKSURL     string
+	JWKSRefresh time.Duration
+	// Tokens are the checks on bearer token claims, beyond the signature.
+	Tokens TokenRules
+	// Auth lists the enabled authentication methods, AuthJWT and AuthMTLS.
+	// JWT alone is the default.
+	Auth []string
+	// ClientCA is a PEM bundle of the CAs trusted to issue client
+	// certificates for AuthMTLS.
+	ClientCA string
+	// ClientMap is a YAML file mapping client certificate subjects and
+	// SANs to the domains they may fetch.
+	ClientMap string
+	// ExpiryWarning is how long before expiry a certificate is reported as
+	// expiring. Zero disables the warning.
+	ExpiryWarning time.Duration
+	// AuditLog is a file that every key release is appended to as a line
+	// of JSON.
+	AuditLog string
+	// RateToken and RateIP limit /cert/ and /watch/ requests a minute for
+	// each token and each client address, allowing bursts of
+	// RateTokenBurst and RateIPBurst. Zero disables a limit.
+	RateToken      float64
+	RateTokenBurst int
+	RateIP         float64
+	RateIPBurst    int
+	// TrustedProxies are the addresses and CIDRs whose X-Forwarded-For is
+	// believed when finding the client address.
+	TrustedProxies []string
+	// Policy is a YAML file capping the domains each subject or issuer may
+	// fetch, reloaded whenever it changes. With PolicyDryRun its denials
+	// are only logged.
+	Policy       string
+	PolicyDryRun bool
+	// Revocations is a file of revoked token IDs, subjects and token
+	// hashes, reloaded whenever it changes.
+	Revocations string
+	// WebhookURLs receive a signed POST whenever a certificate is added,
+	// renewed or removed.
+	WebhookURLs []string
+	// WebhookSecret keys the HMAC signature of webhook deliveries.
+	WebhookSecret string
+	// WebhookQueue is a file keeping undelivered webhooks across restarts.
+	WebhookQueue string
+	// TLSDomain serves HTTPS using the certificate for this domain from
+	// the certificate sources.
+	TLSDomain string
+	// TLSCert and TLSKey serve HTTPS using a keypair from these files
+	// instead.
+	TLSCert string
+	TLSKey  string
 }
 
 func NewServer(o ServerOptions) (*Server, error) {
 	s := &Server{
-		address:  o.Address,
-		key:      o.Key,
-		acmefile: o.AcmeFile,
+		address:   o.Address,
+		clientCA:  o.ClientCA,
+		healthy:   new(int32),
+		shutdown:  make(chan struct{}),
+		logger:    logger.New(),
+		tlsCert:   o.TLSCert,
+		tlsDomain: o.TLSDomain,
+		tlsKey:    o.TLSKey,
+		metrics:   newMetrics(),
+
+		metricsAddress: o.MetricsAddress,
+	}
+	if len(o.Auth) == 0 {
+		o.Auth = []string{AuthJWT}
+	}
+	auth, err := newAuthenticator(o.Auth, o.ClientMap)
+	if err != nil {
+		return nil, err
+	}
+	s.auth = auth
+	s.auth.rules = o.Tokens
+	err = validAlgorithms(o.Tokens.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	if s.auth.jwt {
+		keys := o.Keys
+		if o.Key != "" {
+			keys = append([]string{o.Key}, keys...)
+		}
+		s.auth.keys, err = newKeyring(keys, o.JWKSURL, o.JWKSRefresh, s.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Policy != "" {
+		s.auth.policy, err = newPolicy(o.Policy, o.PolicyDryRun, s.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Revocations != "" {
+		s.auth.revocations, err = newRevocations(o.Revocations, s.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.proxies, err = parseTrustedProxies(o.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if o.RateToken > 0 || o.RateIP > 0 {
+		s.limits = &rateLimits{
+			ip:    newRateLimiter(o.RateIP, o.RateIPBurst),
+			token: newRateLimiter(o.RateToken, o.RateTokenBurst),
+		}
+	}
+	if o.AuditLog != "" {
+		s.audit, err = openAuditLog(o.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.auth.metrics = s.metrics
+	sources := append([]CertificateSource{}, o.Sources...)
+	acmeFiles := o.AcmeFiles
+	if o.AcmeFile != "" {
+		acmeFiles = append([]string{o.AcmeFile}, acmeFiles...)
+	}
+	acmeFiles, err = expandAcmeFiles(acmeFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range acmeFiles {
+		sources = append(sources, NewAcmeSource(path))
+	}
+	for _, dir := range o.PEMDirs {
+		sources = append(sources, NewPEMDirSource(dir))
+	}
+	for _, dir := range o.CertbotDirs {
+		sources = append(sources, NewCertbotSource(dir))
+	}
+	for _, path := range o.FileProviders {
+		sources = append(sources, NewFileProviderSource(path))
+	}
+	store, err := newCertStore(sources, s.logger, s.metrics.observeLoad)
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+	s.metrics.watchStore(store)
+	s.events = newEventBus(store, o.ExpiryWarning, s.logger)
+	if len(o.WebhookURLs) > 0 {
+		s.webhooks, err = newWebhookSender(webhookOptions{
+			URLs:      o.WebhookURLs,
+			Secret:    o.WebhookSecret,
+			QueueFile: o.WebhookQueue,
+		}, s.events, s.logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return s, nil
 }
 
 func (s *Server) Serve() error {
-	s.logger = log.New(os.Stdout, "http: ", log.LstdFlags)
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+
 	s.router = http.NewServeMux()
 	s.router.Handle("/", index())
-	s.router.Handle("/cert/", getCert(s.key, s.acmefile))
+	s.router.Handle("/cert/", getCert(s.auth, s.store, s.limits))
+	s.router.Handle("/watch/", watchCert(s.auth, s.store, s.limits, s.shutdown))
+	s.router.Handle("/events", streamEvents(s.auth, s.events, s.shutdown))
+	s.router.Handle("/admin/certs", listCerts(s.auth, s.store))
 	s.router.Handle("/healthz", healthz(s.healthy))
+	s.router.Handle("/status", status(s.store))
+	if s.metricsAddress == "" {
+		s.router.Handle("/metrics", s.metrics.handler())
+	} else {
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", s.metrics.handler())
+		s.metricsServer = &http.Server{
+			Addr:         s.metricsAddress,
+			Handler:      metricsRouter,
+			ErrorLog:     log.New(errorWriter{s.logger}, "", 0),
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  15 * time.Second,
+		}
+		listener, err := net.Listen("tcp", s.metricsAddress)
+		if err != nil {
+			return fmt.Errorf("could not listen on %s: %v", s.metricsAddress, err)
+		}
+		go s.metricsServer.Serve(listener)
+	}
 	s.server = &http.Server{
 		Addr:         s.address,
-		Handler:      (logging(s.logger)(s.router)),
-		ErrorLog:     s.logger,
+		Handler:      (logging(s.logger, s.audit, s.proxies)(s.metrics.instrument(s.router))),
+		ErrorLog:     log.New(errorWriter{s.logger}, "", 0),
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  15 * time.Second,
 	}
+	s.server.RegisterOnShutdown(func() {
+		close(s.shutdown)
+	})
 
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
@@ -90,19 +316,52 @@ func (s *Server) Serve() error {
 
 		s.server.SetKeepAlivesEnabled(false)
 		if err := s.server.Shutdown(ctx); err != nil {
-			s.logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+			// Carry on so everything below still gets closed
+			s.logger.Error("Could not gracefully shutdown the server",
+				s.logger.Field("error", err.Error()),
+			)
+		}
+		if s.metricsServer != nil {
+			s.metricsServer.Shutdown(ctx)
 		}
 		close(done)
 	}()
 
-	s.logger.Println("Server is ready to handle requests at", s.address)
-	s.healthy = new(int32)
+	s.logger.Info("Server is ready to handle requests",
+		s.logger.Field("address", s.address),
+	)
 	atomic.StoreInt32(s.healthy, 1)
-	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if tlsConfig != nil {
+		// Certificates come from TLSConfig.GetCertificate
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("could not listen on %s: %v", s.address, err)
 	}
 
 	<-done
+	if s.webhooks != nil {
+		s.webhooks.Close()
+	}
+	s.events.Close()
+	s.store.Close()
+	if s.keypair != nil {
+		s.keypair.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	if s.auth.revocations != nil {
+		s.auth.revocations.Close()
+	}
+	if s.auth.keys != nil {
+		s.auth.keys.Close()
+	}
+	if s.auth.policy != nil {
+		s.auth.policy.Close()
+	}
 	s.logger.Println("Server stopped")
 	return nil
 }
@@ -120,91 +379,161 @@ func index() http.Handler {
 	})
 }
 
-func ifExists(needle string, haystack []string) bool {
-	for _, object := range haystack {
-		if object == needle {
-			return true
-		}
-	}
-	return false
-}
-
-func getCert(key string, acmefile string) http.Handler {
+func getCert(auth *authenticator, store *certStore, limits *rateLimits) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check for /domain/
 		domain := strings.TrimPrefix(r.URL.Path, "/cert/")
-		// Check for /domain/
+		// Check for /domain/info
+		info := strings.HasSuffix(domain, "/info")
+		domain = strings.TrimSuffix(domain, "/info")
 		if domain == "" {
 			http.Error(w, "Expected cert", http.StatusBadRequest)
 			return
 		}
+		// HEAD only reveals what info does, so it needs no more access
+		infoOnly := info || r.Method == http.MethodHead
 
-		// Check for empty JWT
-		clientToken := r.Header.Get("Authorization")
-		if clientToken == "" {
-			http.Error(w, "Expected authorization", http.StatusBadRequest)
+		format := types.FormatJSON
+		var err error
+		if !info {
+			format, err = negotiateFormat(r)
+			if err != nil {
+				http.Error(w, "Unsupported format", http.StatusNotAcceptable)
+				return
+			}
+		}
+
+		annotate(r).Domain = domain
+		if !limits.allowIP(w, r) {
 			return
 		}
-		// Check for Bearer
-		if !strings.HasPrefix(clientToken, "Bearer ") {
-			http.Error(w, "Authorization in the wrong form.", http.StatusBadRequest)
+		id, ok := requireIdentity(auth, w, r)
+		if !ok {
 			return
 		}
-		clientToken = strings.TrimPrefix(clientToken, "Bearer ")
-
-		var clientPayload types.Auth
-		err := jwt.Verify(key, clientToken, &clientPayload)
-		if err != nil {
-			log.Printf("Authorization failed: %s %s\n", clientToken, err)
-			http.Error(w, "Authorization failed", http.StatusUnauthorized)
+		if !limits.allowIdentity(w, r, id) {
 			return
 		}
 
-		if !ifExists(domain, clientPayload.Cert.Domains) {
+		if !authorized(domain, id.Domains) &&
+			!(infoOnly && authorized(domain, id.InfoDomains)) {
+			unauthorizedDomain(auth, w)
+			return
+		}
+		if !auth.permitted(r, id, domain) {
 			http.Error(w, "Unauthorized domain", http.StatusUnauthorized)
 			return
 		}
 
-		acmecertsraw, err := ioutil.ReadFile(acmefile)
-		if err != nil {
-			http.Error(w, "Unable to read ACME file", http.StatusInternalServerError)
+		// An empty resolver searches the certificates of every resolver
+		entry := store.Lookup(domain, r.URL.Query().Get("resolver"))
+		if entry == nil {
+			http.Error(w, "Domain not found", http.StatusNotFound)
 			return
 		}
-		var acmecerts types.Acme
-		err = json.Unmarshal(acmecertsraw, &acmecerts)
-		if err != nil {
-			http.Error(w, "Unable to parse ACME file", http.StatusInternalServerError)
+		if !auth.servable(r, id, entry) {
+			http.Error(w, "Unauthorized domain", http.StatusUnauthorized)
 			return
 		}
 
-		var response types.CertResponse
-		for _, acmecert := range acmecerts.Certificates {
-			if acmecert.Domain.Main == domain {
-				response.Cert, err = base64.StdEncoding.DecodeString(acmecert.Certificate)
-				response.Key, err = base64.StdEncoding.DecodeString(acmecert.Key)
-				break
-			}
+		metadata, err := certInfo(entry)
+		if err == nil {
+			setInfoHeaders(w, metadata)
+		} else if infoOnly {
+			annotate(r).Error = fmt.Sprintf("unable to describe certificate: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Unable to marshal response")
+			return
 		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 
-		if response.Cert == nil {
-			http.Error(w, "Domain not found", http.StatusNotFound)
+		if info {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(metadata)
 			return
 		}
 
-		responsejson, err := json.Marshal(response)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, "Unable to marshal response")
+		etag := entityTag(entry, format)
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("ETag", etag)
+		if !noneMatch(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", mediaTypes[format])
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(responsejson)
+		writeCert(w, r, entry, format)
 	})
 }
 
+// requireIdentity authenticates the request, answering it with the reason
+// when that fails.
+func requireIdentity(auth *authenticator, w http.ResponseWriter, r *http.Request) (*identity, bool) {
+	id, err := auth.authenticate(r)
+	if err != nil {
+		refuseIdentity(auth, w, r, err)
+		return nil, false
+	}
+	annotate(r).setIdentity(id)
+	return id, true
+}
+
+// refuseIdentity answers a request whose client failed authentication
+// with the reason.
+func refuseIdentity(auth *authenticator, w http.ResponseWriter, r *http.Request, err error) {
+	authErr := err.(*authError)
+	auth.failed(authErr.Reason)
+	annotate(r).Error = authErr.Error()
+	http.Error(w, authErr.Message, authErr.Status)
+}
+
+// unauthorizedDomain refuses a request for a domain the client wasn't
+// granted.
+func unauthorizedDomain(auth *authenticator, w http.ResponseWriter) {
+	auth.failed("unauthorized_domain")
+	http.Error(w, "Unauthorized domain", http.StatusUnauthorized)
+}
+
+// writeCert answers the request with the certificate and key in format.
+func writeCert(w http.ResponseWriter, r *http.Request, entry *certEntry, format string) {
+	response, err := encodeCert(entry, format, r)
+	if err == errMissingPassword {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		annotate(r).Error = fmt.Sprintf("unable to encode %s as %s: %s", entry.Main, format, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Unable to marshal response")
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", entityTag(entry, format))
+	w.Header().Set("Content-Type", mediaTypes[format])
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+
+	// DER carries only the certificate, every other format includes the key
+	if format != types.FormatDER {
+		release := &keyRelease{
+			Domain:      entry.Main,
+			Resolver:    entry.Resolver,
+			Source:      entry.Source,
+			Fingerprint: entry.Fingerprint,
+			Format:      format,
+		}
+		if entry.Leaf != nil {
+			release.Serial = strings.ToUpper(entry.Leaf.SerialNumber.Text(16))
+		}
+		annotate(r).Release = release
+	}
+}
+
 func healthz(healthy *int32) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if atomic.LoadInt32(healthy) == 1 {
@@ -215,13 +544,36 @@ func healthz(healthy *int32) http.Handler {
 	})
 }
 
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				logger.Println(r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
-			}()
-			next.ServeHTTP(w, r)
-		})
-	}
+func status(store *certStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loaded, certificates, err := store.Status()
+		response := types.StatusResponse{
+			Certificates: certificates,
+		}
+		if !loaded.IsZero() {
+			response.Loaded = &loaded
+		}
+		if err != nil {
+			// The errors name files on the server, so they stay in the log
+			response.Error = "unable to load some certificate sources, see the server log"
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "application/json")
+		if response.Loaded == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// errorWriter sends the http.Server's own errors to the structured log.
+type errorWriter struct {
+	logger *logger.Logger
+}
+
+func (e errorWriter) Write(p []byte) (int, error) {
+	e.logger.Error(strings.TrimSpace(string(p)))
+	return len(p), nil
 }
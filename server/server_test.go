@@ -0,0 +1,61 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+func TestStatusHidesLoadErrors(t *testing.T) {
+	now := time.Now()
+	good := &testSource{name: "/acme/acme.json", certs: []Certificate{
+		testCertificate(t, "", "le", now.Add(-time.Hour), now.Add(time.Hour), "example.com"),
+	}}
+	bad := &testSource{name: "/secret/path/acme.json", err: errors.New("open /secret/path/acme.json: permission denied")}
+	store, err := newCertStore([]CertificateSource{good, bad}, logger.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	w := httptest.NewRecorder()
+	status(store).ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	var response types.StatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Certificates != 1 || response.Error == "" {
+		t.Errorf("response = %+v, want 1 certificate and an error", response)
+	}
+	if strings.Contains(response.Error, "/secret") {
+		t.Errorf("error %q reveals a path", response.Error)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+
+	"github.com/brimstone/logger"
+)
+
+// CertificateSource supplies the certificates serve hands out. Sources are
+// combined, and each is reloaded on its own whenever it reports a change.
+type CertificateSource interface {
+	// Name describes the source in logs, usually by its path.
+	Name() string
+	// Load returns every certificate the source currently holds. An error
+	// keeps the certificates of the previous load.
+	Load() ([]Certificate, error)
+	// Watch calls onChange whenever Load may return something new, until
+	// the returned Closer is closed.
+	Watch(logger *logger.Logger, onChange func()) (io.Closer, error)
+}
+
+// Certificate is a certificate and key as supplied by a CertificateSource.
+type Certificate struct {
+	// Main and SANs are the names the certificate is served for.
+	Main string
+	SANs []string
+	// Resolver is the Traefik certificate resolver that obtained the
+	// certificate, if there is one.
+	Resolver string
+	// Cert is the PEM certificate chain and Key the PEM private key.
+	Cert []byte
+	Key  []byte
+	// Source names where the certificate came from, the Name of its
+	// CertificateSource when empty.
+	Source string
+}
+
+// certificateFromPEM names a certificate after the names in its leaf, the
+// common name first. name is used when the leaf names nothing.
+func certificateFromPEM(cert []byte, key []byte, name string) Certificate {
+	c := Certificate{
+		Main: name,
+		Cert: cert,
+		Key:  key,
+	}
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return c
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return c
+	}
+	switch {
+	case leaf.Subject.CommonName != "":
+		c.Main = leaf.Subject.CommonName
+	case len(leaf.DNSNames) > 0:
+		c.Main = leaf.DNSNames[0]
+	}
+	for _, san := range leaf.DNSNames {
+		if san != c.Main {
+			c.SANs = append(c.SANs, san)
+		}
+	}
+	return c
+}
@@ -0,0 +1,329 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+// certEntry is a certificate from a source, decoded and ready to serve.
+type certEntry struct {
+	Main     string
+	SANs     []string
+	Resolver string
+	// Source names where the certificate came from, such as the path of
+	// its acme.json.
+	Source string
+	Cert   []byte
+	Key    []byte
+	// Leaf is the first certificate in Cert, or nil if it didn't parse.
+	Leaf *x509.Certificate
+	// Fingerprint identifies this exact certificate and key.
+	Fingerprint string
+
+	tlsOnce sync.Once
+	tls     *tls.Certificate
+	tlsErr  error
+}
+
+// Domains returns the main domain of the certificate followed by its SANs.
+func (e *certEntry) Domains() []string {
+	return append([]string{e.Main}, e.SANs...)
+}
+
+// NotAfter returns the expiry of the leaf certificate, or the zero time if
+// the leaf couldn't be parsed.
+func (e *certEntry) NotAfter() time.Time {
+	if e.Leaf == nil {
+		return time.Time{}
+	}
+	return e.Leaf.NotAfter
+}
+
+// ValidAt reports whether the leaf certificate parsed and is valid at t.
+func (e *certEntry) ValidAt(t time.Time) bool {
+	return e.Leaf != nil && !t.Before(e.Leaf.NotBefore) && t.Before(e.Leaf.NotAfter)
+}
+
+func newCertEntry(c Certificate) (*certEntry, error) {
+	if c.Main == "" {
+		return nil, errors.New("no domain")
+	}
+	block, _ := pem.Decode(c.Cert)
+	if block == nil {
+		return nil, errors.New("no PEM certificate")
+	}
+	if key, _ := pem.Decode(c.Key); key == nil {
+		return nil, errors.New("no PEM key")
+	}
+	e := &certEntry{
+		Main:        c.Main,
+		SANs:        c.SANs,
+		Resolver:    c.Resolver,
+		Source:      c.Source,
+		Cert:        c.Cert,
+		Key:         c.Key,
+		Fingerprint: types.Fingerprint(c.Cert, c.Key),
+	}
+	e.Leaf, _ = x509.ParseCertificate(block.Bytes)
+	return e, nil
+}
+
+// certSnapshot is the certificates of every source, indexed by every name
+// they cover. Snapshots are never modified once built.
+type certSnapshot struct {
+	entries []*certEntry
+	index   map[string][]*certEntry
+}
+
+func newCertSnapshot(certs []Certificate, logger *logger.Logger) *certSnapshot {
+	snap := &certSnapshot{
+		index: make(map[string][]*certEntry),
+	}
+	for _, c := range certs {
+		e, err := newCertEntry(c)
+		if err != nil {
+			logger.Printf("Skipping certificate for %s: %s", c.Main, err)
+			continue
+		}
+		snap.entries = append(snap.entries, e)
+		seen := make(map[string]bool)
+		for _, name := range e.Domains() {
+			name = normalizeDomain(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			snap.index[name] = append(snap.index[name], e)
+		}
+	}
+	return snap
+}
+
+// certStore holds the latest good load of each certificate source and
+// reloads a source whenever it changes. A change that can't be read or
+// parsed leaves that source's previous certificates in place.
+type certStore struct {
+	sources  []CertificateSource
+	logger   *logger.Logger
+	watchers []io.Closer
+	// observe is told how long each load took and whether it failed.
+	observe func(duration time.Duration, err error)
+	// reloading serializes reloads, so listeners see snapshots in order.
+	reloading sync.Mutex
+
+	mu sync.RWMutex
+	// certs and errs hold the latest good load and latest error of each
+	// source, in the order of sources.
+	certs    [][]Certificate
+	errs     []error
+	snapshot *certSnapshot
+	loaded   time.Time
+	// changed is closed and replaced after every successful load.
+	changed   chan struct{}
+	listeners []func(old *certSnapshot, new *certSnapshot)
+}
+
+func newCertStore(sources []CertificateSource, logger *logger.Logger, observe func(time.Duration, error)) (*certStore, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no certificate sources")
+	}
+	s := &certStore{
+		sources:  sources,
+		logger:   logger,
+		observe:  observe,
+		certs:    make([][]Certificate, len(sources)),
+		errs:     make([]error, len(sources)),
+		snapshot: &certSnapshot{index: map[string][]*certEntry{}},
+		changed:  make(chan struct{}),
+	}
+	for i, source := range sources {
+		s.reload(i)
+		watcher, err := source.Watch(logger, func() {
+			s.reload(i)
+		})
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("unable to watch %s: %s", source.Name(), err)
+		}
+		s.watchers = append(s.watchers, watcher)
+	}
+	return s, nil
+}
+
+// reload loads the source at index i and rebuilds the snapshot from it and
+// the latest good load of every other source.
+func (s *certStore) reload(i int) {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	source := s.sources[i]
+	start := time.Now()
+	certs, err := source.Load()
+	if s.observe != nil {
+		s.observe(time.Since(start), err)
+	}
+
+	s.mu.Lock()
+	s.errs[i] = err
+	if err != nil {
+		s.mu.Unlock()
+		s.logger.Printf("Unable to load %s, keeping previous certificates: %s", source.Name(), err)
+		return
+	}
+	for j := range certs {
+		if certs[j].Source == "" {
+			certs[j].Source = source.Name()
+		}
+	}
+	s.certs[i] = certs
+	var all []Certificate
+	for _, loaded := range s.certs {
+		all = append(all, loaded...)
+	}
+	old := s.snapshot
+	s.snapshot = newCertSnapshot(all, s.logger)
+	s.loaded = time.Now()
+	close(s.changed)
+	s.changed = make(chan struct{})
+	snapshot := s.snapshot
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	s.logger.Printf("Loaded %d certificates from %s", len(certs), source.Name())
+	for _, listener := range listeners {
+		listener(old, snapshot)
+	}
+}
+
+// OnChange registers a function to call with the previous and new snapshot
+// after each successful reload. Reloads are serialized, so calls are too.
+func (s *certStore) OnChange(listener func(old *certSnapshot, new *certSnapshot)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// Status returns when a source was last loaded successfully, how many
+// certificates are being served, and the errors of the sources whose
+// latest load failed.
+func (s *certStore) Status() (loaded time.Time, certificates int, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var errs []error
+	for i, err := range s.errs {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", s.sources[i].Name(), err))
+		}
+	}
+	return s.loaded, len(s.snapshot.entries), errors.Join(errs...)
+}
+
+// Changed returns a channel that's closed the next time a source is
+// loaded. Get it before looking anything up to avoid missing a reload in
+// between.
+func (s *certStore) Changed() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changed
+}
+
+func (s *certStore) current() *certSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot
+}
+
+// Lookup returns the certificate to serve for domain, optionally limited to
+// a single resolver. A valid certificate naming the domain exactly is
+// preferred over one covering it by wildcard. Otherwise the exact and
+// wildcard matches are weighed together, and the one preferable picks
+// wins.
+func (s *certStore) Lookup(domain string, resolver string) *certEntry {
+	domain = normalizeDomain(domain)
+	snap := s.current()
+	exact := preferred(snap.index[domain], resolver)
+	if exact != nil && exact.ValidAt(time.Now()) {
+		return exact
+	}
+	if strings.Contains(domain, "*") {
+		return exact
+	}
+	label, rest, found := strings.Cut(domain, ".")
+	if !found || label == "" {
+		return exact
+	}
+	wildcard := "*." + rest
+	if !validWildcard(wildcard) {
+		return exact
+	}
+	candidates := snap.index[wildcard]
+	if exact != nil {
+		candidates = append([]*certEntry{exact}, candidates...)
+	}
+	return preferred(candidates, resolver)
+}
+
+// preferred returns the entry preferable picks over every other, ignoring
+// entries from other resolvers when one is given.
+func preferred(entries []*certEntry, resolver string) *certEntry {
+	now := time.Now()
+	var best *certEntry
+	for _, e := range entries {
+		if resolver != "" && e.Resolver != resolver {
+			continue
+		}
+		if best == nil || preferable(e, best, now) {
+			best = e
+		}
+	}
+	return best
+}
+
+// preferable reports whether a should be served rather than b when both
+// cover the same name, as happens when several sources hold it. A currently
+// valid certificate beats one that isn't, then the most recently issued
+// wins, then the one remaining valid the longest.
+func preferable(a *certEntry, b *certEntry, now time.Time) bool {
+	if aValid, bValid := a.ValidAt(now), b.ValidAt(now); aValid != bValid {
+		return aValid
+	}
+	if a.Leaf != nil && b.Leaf != nil && !a.Leaf.NotBefore.Equal(b.Leaf.NotBefore) {
+		return a.Leaf.NotBefore.After(b.Leaf.NotBefore)
+	}
+	return a.NotAfter().After(b.NotAfter())
+}
+
+func (s *certStore) Close() error {
+	for _, watcher := range s.watchers {
+		watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/brimstone/logger"
+)
+
+// testSource is a CertificateSource whose certificates the test sets.
+type testSource struct {
+	name  string
+	certs []Certificate
+	err   error
+}
+
+func (s *testSource) Name() string {
+	return s.name
+}
+
+func (s *testSource) Load() ([]Certificate, error) {
+	return s.certs, s.err
+}
+
+func (s *testSource) Watch(logger *logger.Logger, onChange func()) (io.Closer, error) {
+	return io.NopCloser(nil), nil
+}
+
+// testCertificate returns a self-signed certificate for names, valid from
+// notBefore until notAfter and labelled with source.
+func testCertificate(t *testing.T, source string, resolver string, notBefore time.Time, notAfter time.Time, names ...string) Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate{
+		Main:     names[0],
+		SANs:     names[1:],
+		Resolver: resolver,
+		Cert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		Source:   source,
+	}
+}
+
+func TestLookup(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	first := &testSource{name: "first", certs: []Certificate{
+		testCertificate(t, "exact", "le", now.Add(-30*day), now.Add(30*day), "exact.example.com"),
+		testCertificate(t, "wild", "le", now.Add(-day), now.Add(60*day), "*.example.com"),
+		testCertificate(t, "stale", "le", now.Add(-120*day), now.Add(-30*day), "stale.example.com"),
+		testCertificate(t, "expired-only", "le", now.Add(-120*day), now.Add(-30*day), "old.example.org"),
+		testCertificate(t, "le", "le", now.Add(-30*day), now.Add(30*day), "multi.example.net"),
+		testCertificate(t, "older", "le", now.Add(-2*day), now.Add(60*day), "new.example.net"),
+		testCertificate(t, "valid", "le", now.Add(-60*day), now.Add(30*day), "valid.example.net"),
+		testCertificate(t, "short", "le", now.Add(-day), now.Add(day), "tie.example.net"),
+	}}
+	second := &testSource{name: "second", certs: []Certificate{
+		testCertificate(t, "zerossl", "zerossl", now.Add(-day), now.Add(60*day), "multi.example.net"),
+		testCertificate(t, "newer", "le", now.Add(-day), now.Add(60*day), "new.example.net"),
+		testCertificate(t, "expired-newer", "le", now.Add(-2*day), now.Add(-day), "valid.example.net"),
+		testCertificate(t, "long", "le", now.Add(-day), now.Add(60*day), "tie.example.net"),
+	}}
+	store, err := newCertStore([]CertificateSource{first, second}, logger.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tests := []struct {
+		domain   string
+		resolver string
+		want     string
+	}{
+		{"exact.example.com", "", "exact"},
+		{"EXACT.example.com.", "", "exact"},
+		{"mail.example.com", "", "wild"},
+		{"*.example.com", "", "wild"},
+		{"example.com", "", ""},
+		{"a.b.example.com", "", ""},
+		{"stale.example.com", "", "wild"},
+		{"old.example.org", "", "expired-only"},
+		{"multi.example.net", "", "zerossl"},
+		{"multi.example.net", "le", "le"},
+		{"multi.example.net", "other", ""},
+		{"mail.example.com", "zerossl", ""},
+		{"new.example.net", "", "newer"},
+		{"valid.example.net", "", "valid"},
+		{"tie.example.net", "", "long"},
+		{"missing.example.net", "", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if e := store.Lookup(tt.domain, tt.resolver); e != nil {
+			got = e.Source
+		}
+		if got != tt.want {
+			t.Errorf("Lookup(%q, %q) = %q, want %q", tt.domain, tt.resolver, got, tt.want)
+		}
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	now := time.Now()
+	source := &testSource{name: "acme.json", certs: []Certificate{
+		testCertificate(t, "", "le", now.Add(-time.Hour), now.Add(24*time.Hour), "mail.example.com"),
+	}}
+	store, err := newCertStore([]CertificateSource{source}, logger.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	first := store.Lookup("mail.example.com", "")
+	if first == nil || first.Source != "acme.json" {
+		t.Fatalf("Lookup() = %v, want the certificate from acme.json", first)
+	}
+
+	// A load that fails keeps the previous certificates and is reported.
+	changed := store.Changed()
+	source.err = io.ErrUnexpectedEOF
+	store.reload(0)
+	if e := store.Lookup("mail.example.com", ""); e != first {
+		t.Errorf("Lookup() after a failed load = %v, want the previous certificate", e)
+	}
+	if _, certificates, err := store.Status(); certificates != 1 || err == nil {
+		t.Errorf("Status() = %d certificates, %v, want 1 and the load error", certificates, err)
+	}
+	select {
+	case <-changed:
+		t.Error("Changed() fired for a failed load")
+	default:
+	}
+
+	// The next good load replaces them.
+	source.err = nil
+	source.certs = []Certificate{
+		testCertificate(t, "", "le", now.Add(-time.Minute), now.Add(48*time.Hour), "mail.example.com"),
+	}
+	store.reload(0)
+	second := store.Lookup("mail.example.com", "")
+	if second == nil || second.Fingerprint == first.Fingerprint {
+		t.Errorf("Lookup() after a good load = %v, want the new certificate", second)
+	}
+	if _, _, err := store.Status(); err != nil {
+		t.Errorf("Status() error = %v after a good load", err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("Changed() didn't fire for a good load")
+	}
+}
@@ -0,0 +1,165 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/brimstone/logger"
+)
+
+// TLSCertificate returns the entry as a certificate the TLS listener can
+// present. It's parsed on first use and cached, since entries never change.
+func (e *certEntry) TLSCertificate() (*tls.Certificate, error) {
+	e.tlsOnce.Do(func() {
+		var cert tls.Certificate
+		cert, e.tlsErr = tls.X509KeyPair(e.Cert, e.Key)
+		if e.tlsErr == nil {
+			e.tls = &cert
+		}
+	})
+	return e.tls, e.tlsErr
+}
+
+// tlsConfig builds the listener configuration from the server options, or
+// returns nil when the server should speak plain HTTP.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.tlsDomain != "" && (s.tlsCert != "" || s.tlsKey != "") {
+		return nil, errors.New("TLS domain and TLS cert/key files are mutually exclusive")
+	}
+	if (s.tlsCert == "") != (s.tlsKey == "") {
+		return nil, errors.New("TLS cert and key files must be given together")
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	switch {
+	case s.tlsDomain != "":
+		if s.store.Lookup(s.tlsDomain, "") == nil {
+			s.logger.Printf("No certificate for %s yet, TLS handshakes will fail until Traefik obtains one", s.tlsDomain)
+		}
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Look the certificate up on every handshake so renewals are
+			// picked up as soon as the store reloads
+			entry := s.store.Lookup(s.tlsDomain, "")
+			if entry == nil {
+				return nil, fmt.Errorf("no certificate for %s", s.tlsDomain)
+			}
+			return entry.TLSCertificate()
+		}
+	case s.tlsCert != "":
+		kp, err := newKeypair(s.tlsCert, s.tlsKey, s.logger)
+		if err != nil {
+			return nil, err
+		}
+		s.keypair = kp
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return kp.Certificate(), nil
+		}
+	default:
+		if s.auth.mtls {
+			return nil, errors.New("mutual TLS requires a TLS domain or TLS cert/key files")
+		}
+		return nil, nil
+	}
+
+	if s.auth.mtls {
+		if s.clientCA == "" {
+			return nil, errors.New("mutual TLS requires a client CA bundle")
+		}
+		bundle, err := os.ReadFile(s.clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA bundle: %s", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("no certificates found in client CA bundle")
+		}
+		// Certificates are optional during the handshake so /healthz keeps
+		// working; the handlers decide whether one is required
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// keypair is a certificate and key loaded from separate files, reloaded
+// when the certificate file changes. A pair that fails to load leaves the
+// previous one in place.
+type keypair struct {
+	certfile string
+	keyfile  string
+	logger   *logger.Logger
+	watchers []*fileWatcher
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newKeypair(certfile string, keyfile string, logger *logger.Logger) (*keypair, error) {
+	kp := &keypair{
+		certfile: certfile,
+		keyfile:  keyfile,
+		logger:   logger,
+	}
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS keypair: %s", err)
+	}
+	kp.cert = &cert
+	for _, path := range []string{certfile, keyfile} {
+		watcher, err := watchFile(path, logger, kp.reload)
+		if err != nil {
+			kp.Close()
+			return nil, fmt.Errorf("unable to watch %s: %s", path, err)
+		}
+		kp.watchers = append(kp.watchers, watcher)
+	}
+	return kp, nil
+}
+
+func (kp *keypair) reload() {
+	cert, err := tls.LoadX509KeyPair(kp.certfile, kp.keyfile)
+	if err != nil {
+		kp.logger.Printf("Unable to reload TLS keypair, keeping previous one: %s", err)
+		return
+	}
+	kp.mu.Lock()
+	kp.cert = &cert
+	kp.mu.Unlock()
+	kp.logger.Printf("Reloaded TLS keypair from %s", kp.certfile)
+}
+
+func (kp *keypair) Certificate() *tls.Certificate {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert
+}
+
+func (kp *keypair) Close() error {
+	for _, watcher := range kp.watchers {
+		watcher.Close()
+	}
+	return nil
+}
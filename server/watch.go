@@ -0,0 +1,121 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// settleDelay gives a writer time to finish before a changed file is read,
+// so a burst of events from one rewrite causes a single reload.
+const settleDelay = 250 * time.Millisecond
+
+// fileWatcher calls a function whenever a watched file changes.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// watchFile calls onChange after path is written, created, replaced or
+// removed. The parent directory is watched rather than the file itself so
+// that atomic renames and recreated files are noticed too.
+func watchFile(path string, logger *logger.Logger, onChange func()) (*fileWatcher, error) {
+	name := filepath.Clean(path)
+	return watchPath(filepath.Dir(path), func(changed string) bool {
+		return filepath.Clean(changed) == name
+	}, logger, onChange)
+}
+
+// watchDir calls onChange after any file in dir changes.
+func watchDir(dir string, logger *logger.Logger, onChange func()) (*fileWatcher, error) {
+	return watchPath(dir, func(string) bool {
+		return true
+	}, logger, onChange)
+}
+
+// watchPath watches dir for changes to the files accepted by match.
+func watchPath(dir string, match func(name string) bool, logger *logger.Logger, onChange func()) (*fileWatcher, error) {
+	return watchDirs(func() []string {
+		return []string{dir}
+	}, match, logger, onChange)
+}
+
+// watchDirs watches the directories returned by dirs for changes to the
+// files accepted by match. dirs is asked again after every change, so
+// directories created since are watched too.
+func watchDirs(dirs func() []string, match func(name string) bool, logger *logger.Logger, onChange func()) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs() {
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	fw := &fileWatcher{
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !match(event.Name) || event.Op == fsnotify.Chmod {
+					continue
+				}
+				settle = time.After(settleDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Printf("Watching for changes failed: %s", err)
+			case <-settle:
+				settle = nil
+				// Adding a directory already watched does nothing
+				for _, dir := range dirs() {
+					err := watcher.Add(dir)
+					if err != nil {
+						logger.Printf("Unable to watch %s: %s", dir, err)
+					}
+				}
+				onChange()
+			case <-fw.done:
+				return
+			}
+		}
+	}()
+	return fw, nil
+}
+
+func (fw *fileWatcher) Close() error {
+	close(fw.done)
+	return fw.watcher.Close()
+}
@@ -0,0 +1,258 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried before it's
+	// dropped.
+	webhookMaxAttempts = 20
+	// webhookMaxBackoff caps the delay between attempts.
+	webhookMaxBackoff = time.Hour
+	// webhookTimeout limits a single attempt.
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookDelivery is one event waiting to be posted to one URL.
+type webhookDelivery struct {
+	URL         string      `json:"url"`
+	Event       types.Event `json:"event"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt time.Time   `json:"next_attempt"`
+}
+
+type webhookOptions struct {
+	URLs   []string
+	Secret string
+	// QueueFile persists pending deliveries across restarts. Without it
+	// they're only kept in memory.
+	QueueFile string
+	// Client posts the deliveries, http.DefaultClient with a timeout if nil.
+	Client *http.Client
+}
+
+// webhookSender posts signed added, renewed and removed events to every
+// configured URL, retrying failures with exponential backoff.
+type webhookSender struct {
+	webhookOptions
+	bus    *eventBus
+	logger *logger.Logger
+	done   chan struct{}
+	queue  []webhookDelivery
+}
+
+func newWebhookSender(o webhookOptions, bus *eventBus, logger *logger.Logger) (*webhookSender, error) {
+	if o.Secret == "" {
+		return nil, errors.New("webhooks require a secret to sign deliveries")
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: webhookTimeout}
+	}
+	ws := &webhookSender{
+		webhookOptions: o,
+		bus:            bus,
+		logger:         logger,
+		done:           make(chan struct{}),
+	}
+	if o.QueueFile != "" {
+		raw, err := os.ReadFile(o.QueueFile)
+		if err == nil {
+			err = json.Unmarshal(raw, &ws.queue)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unable to load webhook queue: %s", err)
+		}
+		if len(ws.queue) > 0 {
+			logger.Printf("Resuming %d webhook deliveries", len(ws.queue))
+		}
+	}
+	go ws.run()
+	return ws, nil
+}
+
+func (ws *webhookSender) run() {
+	last := ws.bus.LastID()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		events, changed := ws.bus.Since(last)
+		for _, event := range events {
+			last = event.ID
+			if event.Type == types.EventExpiring {
+				continue
+			}
+			for _, url := range ws.URLs {
+				ws.queue = append(ws.queue, webhookDelivery{
+					URL:         url,
+					Event:       event,
+					NextAttempt: time.Now(),
+				})
+			}
+		}
+		if len(events) > 0 {
+			ws.save()
+		}
+
+		ws.deliverDue()
+
+		timer.Reset(ws.untilNext())
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ws.done:
+			return
+		}
+	}
+}
+
+// deliverDue attempts every delivery whose time has come, rescheduling or
+// dropping the ones that fail.
+func (ws *webhookSender) deliverDue() {
+	now := time.Now()
+	pending := ws.queue[:0]
+	dirty := false
+	for _, d := range ws.queue {
+		if d.NextAttempt.After(now) {
+			pending = append(pending, d)
+			continue
+		}
+		dirty = true
+		d.Attempts++
+		err := ws.deliver(d)
+		if err == nil {
+			continue
+		}
+		if d.Attempts >= webhookMaxAttempts {
+			ws.logger.Printf("Dropping webhook %s for %s %s after %d attempts: %s", d.URL, d.Event.Type, d.Event.Domain, d.Attempts, err)
+			continue
+		}
+		backoff := time.Second << uint(d.Attempts)
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttempt = now.Add(backoff)
+		ws.logger.Printf("Webhook %s for %s %s failed, retrying in %s: %s", d.URL, d.Event.Type, d.Event.Domain, backoff, err)
+		pending = append(pending, d)
+	}
+	ws.queue = pending
+	if dirty {
+		ws.save()
+	}
+}
+
+// untilNext returns how long until the earliest pending delivery is due.
+func (ws *webhookSender) untilNext() time.Duration {
+	next := webhookMaxBackoff
+	for _, d := range ws.queue {
+		if until := time.Until(d.NextAttempt); until < next {
+			next = until
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+func (ws *webhookSender) deliver(d webhookDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "traefik-cert")
+	req.Header.Set(types.WebhookEventHeader, d.Event.Type)
+	req.Header.Set(types.WebhookDeliveryHeader, strconv.FormatUint(d.Event.ID, 10))
+	req.Header.Set(types.WebhookSignatureHeader, signWebhook([]byte(ws.Secret), body))
+
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value for a body.
+func signWebhook(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// save writes the pending deliveries to the queue file, replacing it
+// atomically so a crash never leaves it half written.
+func (ws *webhookSender) save() {
+	if ws.QueueFile == "" {
+		return
+	}
+	raw, err := json.Marshal(ws.queue)
+	if err != nil {
+		ws.logger.Printf("Unable to save webhook queue: %s", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ws.QueueFile), ".webhooks-*")
+	if err != nil {
+		ws.logger.Printf("Unable to save webhook queue: %s", err)
+		return
+	}
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ws.QueueFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		ws.logger.Printf("Unable to save webhook queue: %s", err)
+	}
+}
+
+func (ws *webhookSender) Close() error {
+	close(ws.done)
+	return nil
+}
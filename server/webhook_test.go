@@ -0,0 +1,178 @@
+/*
+
+Copyright © 2024 Matt Robinson <brimstone@the.narro.ws>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brimstone/logger"
+	"github.com/brimstone/traefik-cert/client"
+	"github.com/brimstone/traefik-cert/types"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan receivedWebhook, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case received <- receivedWebhook{header: r.Header, body: body}:
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	log := logger.New()
+	bus := &eventBus{
+		logger:  log,
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	ws, err := newWebhookSender(webhookOptions{
+		URLs:   []string{srv.URL},
+		Secret: "s3cret",
+		Client: srv.Client(),
+	}, bus, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// The sender only delivers events published after it starts, so keep
+	// publishing until the first one arrives.
+	var got receivedWebhook
+	deadline := time.After(5 * time.Second)
+wait:
+	for {
+		bus.publish(
+			types.Event{Type: types.EventExpiring, Domain: "example.com"},
+			types.Event{Type: types.EventAdded, Domain: "example.com"},
+		)
+		select {
+		case got = <-received:
+			break wait
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no webhook delivered")
+		}
+	}
+
+	var event types.Event
+	if err := json.Unmarshal(got.body, &event); err != nil {
+		t.Fatalf("unable to decode delivery: %s", err)
+	}
+	if event.Type != types.EventAdded || event.Domain != "example.com" {
+		t.Errorf("delivered %s %s, want %s example.com", event.Type, event.Domain, types.EventAdded)
+	}
+	if h := got.header.Get(types.WebhookEventHeader); h != types.EventAdded {
+		t.Errorf("%s = %q, want %q", types.WebhookEventHeader, h, types.EventAdded)
+	}
+	if h := got.header.Get(types.WebhookDeliveryHeader); h != strconv.FormatUint(event.ID, 10) {
+		t.Errorf("%s = %q, want %d", types.WebhookDeliveryHeader, h, event.ID)
+	}
+	signature := got.header.Get(types.WebhookSignatureHeader)
+	if !client.VerifyWebhook("s3cret", got.body, signature) {
+		t.Errorf("signature %q doesn't verify", signature)
+	}
+	if client.VerifyWebhook("other", got.body, signature) {
+		t.Error("signature verifies with the wrong secret")
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var requests, failing atomic.Int32
+	failing.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	ws := &webhookSender{
+		webhookOptions: webhookOptions{Secret: "s3cret", Client: srv.Client()},
+		logger:         logger.New(),
+		queue: []webhookDelivery{{
+			URL:         srv.URL,
+			Event:       types.Event{ID: 1, Type: types.EventRenewed, Domain: "example.com"},
+			NextAttempt: time.Now(),
+		}},
+	}
+
+	ws.deliverDue()
+	if len(ws.queue) != 1 {
+		t.Fatalf("%d deliveries queued after a failure, want 1", len(ws.queue))
+	}
+	if ws.queue[0].Attempts != 1 {
+		t.Errorf("attempts = %d, want 1", ws.queue[0].Attempts)
+	}
+	if !ws.queue[0].NextAttempt.After(time.Now()) {
+		t.Errorf("next attempt %s isn't in the future", ws.queue[0].NextAttempt)
+	}
+
+	// Not due yet, so nothing is sent.
+	ws.deliverDue()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests before the retry was due, want 1", n)
+	}
+
+	failing.Store(0)
+	ws.queue[0].NextAttempt = time.Now()
+	ws.deliverDue()
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+	if len(ws.queue) != 0 {
+		t.Errorf("%d deliveries queued after a success, want 0", len(ws.queue))
+	}
+}
+
+func TestWebhookDropped(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ws := &webhookSender{
+		webhookOptions: webhookOptions{Secret: "s3cret", Client: srv.Client()},
+		logger:         logger.New(),
+		queue: []webhookDelivery{{
+			URL:         srv.URL,
+			Event:       types.Event{ID: 1, Type: types.EventRemoved, Domain: "example.com"},
+			Attempts:    webhookMaxAttempts - 1,
+			NextAttempt: time.Now(),
+		}},
+	}
+	ws.deliverDue()
+	if len(ws.queue) != 0 {
+		t.Errorf("%d deliveries queued after the last attempt, want 0", len(ws.queue))
+	}
+}
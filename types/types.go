@@ -18,36 +18,207 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 
 package types
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Acme is the Traefik v1 layout of acme.json, with a single account and
+// certificate list at the top level.
 type Acme struct {
-	Account struct {
-		Email        string `json:"Email"`
-		Registration struct {
-			Body struct {
-				Status string `json:"status"`
-			} `json:"body"`
-			URI string `json:"uri"`
-		} `json:"Registration"`
-		PrivateKey string `json:"PrivateKey"`
-	} `json:"Account"`
-	Certificates []struct {
-		Domain struct {
-			Main string      `json:"Main"`
-			SANs interface{} `json:"SANs"`
-		} `json:"Domain"`
-		Certificate string `json:"Certificate"`
-		Key         string `json:"Key"`
-	} `json:"Certificates"`
+	Account        AcmeAccount       `json:"Account"`
+	Certificates   []AcmeCertificate `json:"Certificates"`
 	HTTPChallenges struct {
 	} `json:"HTTPChallenges"`
 }
 
+// AcmeV2 is the Traefik v2 and v3 layout of acme.json, keyed by the name of
+// the certificate resolver.
+type AcmeV2 map[string]AcmeResolver
+
+// AcmeResolver holds the account and certificates of a single resolver in
+// the Traefik v2 and v3 layout.
+type AcmeResolver struct {
+	Account      *AcmeAccount      `json:"Account"`
+	Certificates []AcmeCertificate `json:"Certificates"`
+}
+
+type AcmeAccount struct {
+	Email        string `json:"Email"`
+	Registration struct {
+		Body struct {
+			Status string `json:"status"`
+		} `json:"body"`
+		URI string `json:"uri"`
+	} `json:"Registration"`
+	PrivateKey string `json:"PrivateKey"`
+	KeyType    string `json:"KeyType,omitempty"`
+}
+
+// AcmeCertificate is a certificate as stored by any version of Traefik.
+// Traefik v1 capitalizes the field names while v2 and later use lowercase
+// ones, which encoding/json matches without help.
+type AcmeCertificate struct {
+	Domain struct {
+		Main string   `json:"Main"`
+		SANs []string `json:"SANs"`
+	} `json:"Domain"`
+	Certificate string `json:"Certificate"`
+	Key         string `json:"Key"`
+	Store       string `json:"Store,omitempty"`
+}
+
+// Domains returns the main domain of the certificate followed by its SANs.
+func (c AcmeCertificate) Domains() []string {
+	return append([]string{c.Domain.Main}, c.Domain.SANs...)
+}
+
 type Auth struct {
-	Cert struct {
+	Subject string `json:"sub,omitempty"`
+	Issuer  string `json:"iss,omitempty"`
+	// Audience names the services the token is meant for.
+	Audience Audience `json:"aud,omitempty"`
+	// ID identifies the token itself, for auditing and revocation.
+	ID string `json:"jti,omitempty"`
+	// Admin grants the admin API, which describes every certificate.
+	Admin bool `json:"admin,omitempty"`
+	// IssuedAt, NotBefore and Expires are Unix times.
+	IssuedAt  int64 `json:"iat,omitempty"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	Expires   int64 `json:"exp,omitempty"`
+	Cert      struct {
+		// Domains may be fetched with their private keys.
 		Domains []string `json:"domains"`
+		// Info domains may only have their metadata inspected.
+		Info []string `json:"info,omitempty"`
 	} `json:"cert"`
 }
 
+// Audience is the aud claim, which is either a single string or a list.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(raw []byte) error {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(raw, &list)
+	if err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
 type CertResponse struct {
 	Cert []byte `json:"cert"`
 	Key  []byte `json:"key"`
 }
+
+// Fingerprint identifies a certificate and key pair. The server uses it as
+// the ETag of a JSON response, so a client can compute it from the files it
+// saved last time.
+func Fingerprint(cert []byte, key []byte) string {
+	sum := sha256.New()
+	sum.Write(cert)
+	sum.Write(key)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// TokenHash identifies a bearer token without revealing it, for revoking a
+// token that has no jti.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+// StatusResponse reports the state of the certificates loaded by the server.
+type StatusResponse struct {
+	Loaded       *time.Time `json:"loaded,omitempty"`
+	Certificates int        `json:"certificates"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Formats a certificate can be requested in, with the format query parameter
+// or the matching media type in the Accept header.
+const (
+	// FormatJSON is a CertResponse.
+	FormatJSON = "json"
+	// FormatPEM is the certificate chain followed by the private key.
+	FormatPEM = "pem"
+	// FormatDER is the leaf certificate alone.
+	FormatDER = "der"
+	// FormatPKCS12 is the chain and private key protected by the password
+	// in PKCS12PasswordHeader.
+	FormatPKCS12 = "pkcs12"
+)
+
+// PKCS12PasswordHeader is the request header holding the password for a
+// FormatPKCS12 response. A header keeps it out of access logs.
+const PKCS12PasswordHeader = "X-PKCS12-Password"
+
+// CertInfo describes a served certificate without its private key.
+type CertInfo struct {
+	Domain          string    `json:"domain"`
+	SANs            []string  `json:"sans"`
+	Resolver        string    `json:"resolver,omitempty"`
+	Source          string    `json:"source,omitempty"`
+	Subject         string    `json:"subject"`
+	Issuer          string    `json:"issuer"`
+	Serial          string    `json:"serial"`
+	NotBefore       time.Time `json:"not_before"`
+	NotAfter        time.Time `json:"not_after"`
+	KeyType         string    `json:"key_type"`
+	KeySize         int       `json:"key_size"`
+	Fingerprint     string    `json:"fingerprint_sha256"`
+	SPKIFingerprint string    `json:"spki_sha256"`
+}
+
+// CertListResponse answers the admin API's list of certificates.
+type CertListResponse struct {
+	Certificates []CertInfo `json:"certificates"`
+}
+
+// Kinds of Event.
+const (
+	EventAdded    = "added"
+	EventRenewed  = "renewed"
+	EventRemoved  = "removed"
+	EventExpiring = "expiring"
+)
+
+// Event is a change to a served certificate.
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Domain   string    `json:"domain"`
+	SANs     []string  `json:"sans,omitempty"`
+	Resolver string    `json:"resolver,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Serial   string    `json:"serial,omitempty"`
+	NotAfter time.Time `json:"not_after,omitempty"`
+	// Fingerprint matches the ETag of the certificate's JSON response. It's
+	// empty for EventRemoved.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Headers sent with every webhook delivery. The signature is "sha256="
+// followed by the hex HMAC-SHA256 of the body, keyed with the shared secret.
+const (
+	WebhookSignatureHeader = "X-Traefik-Cert-Signature"
+	WebhookEventHeader     = "X-Traefik-Cert-Event"
+	WebhookDeliveryHeader  = "X-Traefik-Cert-Delivery"
+)